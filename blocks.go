@@ -0,0 +1,91 @@
+package vorlage
+
+import (
+	"io"
+	"strings"
+)
+
+// namedBlock is a parsed #block and the #endblock that ends it.
+type namedBlock struct {
+	doc  *Document
+	name string
+	pos  *macoPos
+	end  *macoPos
+}
+
+// parses the arguments of a #block macro found in doc
+func parseBlock(doc *Document, m *macoPos) (*namedBlock, *Error) {
+	name := strings.Join(m.args[1:], string(MacroArgument))
+	if !macroParameterRegexpProc.MatchString(name) {
+		oerr := NewError("#block has an invalid name")
+		oerr.SetSubjectf("'%s' %s", name, m.ToString())
+		return nil, oerr
+	}
+	if _, ok := doc.blockNames[name]; ok {
+		oerr := NewError(errDuplicateBlock)
+		oerr.SetSubjectf("'%s' %s", name, m.ToString())
+		return nil, oerr
+	}
+	return &namedBlock{doc: doc, name: name, pos: m}, nil
+}
+
+// returns the block that is to be read in place of b. That's the block with
+// the same name found in the document furthest down the #extends chain, which
+// is b itself if no document that extends b's document has one.
+func (b *namedBlock) override() *namedBlock {
+	bottom := b.doc
+	for bottom.extendedBy != nil {
+		bottom = bottom.extendedBy
+	}
+	for d := bottom; d != nil && d != b.doc; d = d.layout {
+		if o, ok := d.blockNames[b.name]; ok {
+			return o
+		}
+	}
+	return b
+}
+
+// creates a file that reads the content between b's #block and #endblock in
+// place of what c is reading. The macros in between are ran as usual.
+func (c *nonConvertedFile) blockReader(b *namedBlock) *nonConvertedFile {
+	start := int64(b.pos.charPos) + int64(b.pos.length)
+	end := int64(b.end.charPos)
+
+	// only the directives inside of the block.
+	var first, last int
+	directives := b.doc.bodyPos
+	for first = 0; first < len(directives) && directives[first] != b.pos; first++ {
+	}
+	for last = first; last < len(directives) && directives[last] != b.end; last++ {
+	}
+
+	return &nonConvertedFile{
+		sourceDocument: b.doc,
+		// the block is read as part of b.doc, not the layout.
+		includer: b.doc.includer(),
+		sourceFile: sectionFile{
+			io.NewSectionReader(b.doc.rawFile, start, end-start),
+		},
+		delims:             b.doc.delimiters,
+		variableReadBuffer: newVariableReadBuffer(b.doc.compiler.maxVariableLength()),
+		definitionStack:    c.definitionStack,
+		scopes:             c.scopes,
+		inheritedScopes:    len(c.scopes),
+		directives:         directives[first+1 : last],
+		contentStart:       start,
+	}
+}
+
+// sectionFile is a File that is only part of a document's raw file.
+type sectionFile struct {
+	*io.SectionReader
+}
+
+func (s sectionFile) Reset() error {
+	_, err := s.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s sectionFile) Close() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package vorlage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtends(t *testing.T) {
+	layout := "<title>\n#block title\nMy Site\n#endblock\n</title>\n" +
+		"<main>\n#block content\nNothing here yet.\n#endblock\n</main>\n"
+	tests := []struct {
+		name   string
+		files  map[string]string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "overrides",
+			files: map[string]string{
+				"layout.html": layout,
+				"doc.html": "#extends layout.html\n#block title\nAbout\n#endblock\n" +
+					"#block content\n<p>me</p>\n#endblock\n",
+			},
+			output: "<title>\nAbout\n</title>\n<main>\n<p>me</p>\n</main>\n"},
+		{name: "blocks that are not overridden",
+			files: map[string]string{
+				"layout.html": layout,
+				"doc.html":    "#extends layout.html\n#block title\nAbout\n#endblock\n",
+			},
+			output: "<title>\nAbout\n</title>\n<main>\nNothing here yet.\n</main>\n"},
+		{name: "content outside of blocks is ignored",
+			files: map[string]string{
+				"layout.html": layout,
+				"doc.html": "#extends layout.html\nignored\n" +
+					"#block title\nAbout\n#endblock\nignored\n",
+			},
+			output: "<title>\nAbout\n</title>\n<main>\nNothing here yet.\n</main>\n"},
+		{name: "without a layout",
+			files: map[string]string{
+				"doc.html": "a\n#block title\nb\n#endblock\nc\n",
+			},
+			output: "a\nb\nc\n"},
+		{name: "furthest down the chain",
+			files: map[string]string{
+				"base.html": layout,
+				"layout.html": "#extends base.html\n#block title\nLayout\n#endblock\n" +
+					"#block content\nLayout\n#endblock\n",
+				"doc.html": "#extends layout.html\n#block content\nDoc\n#endblock\n",
+			},
+			output: "<title>\nLayout\n</title>\n<main>\nDoc\n</main>\n"},
+		{name: "nested blocks",
+			files: map[string]string{
+				"layout.html": "#block outer\n[\n#block inner\ninner\n#endblock\n]\n#endblock\n",
+				"doc.html":    "#extends layout.html\n#block inner\nmine\n#endblock\n",
+			},
+			output: "[\nmine\n]\n"},
+		{name: "overriding the outer block",
+			files: map[string]string{
+				"layout.html": "#block outer\n[\n#block inner\ninner\n#endblock\n]\n#endblock\n",
+				"doc.html":    "#extends layout.html\n#block outer\nmine\n#endblock\n",
+			},
+			output: "mine\n"},
+		{name: "the child's definitions are kept over the layout's",
+			files: map[string]string{
+				"layout.html": "#define $(Name) layout\n" +
+					"#block title\n$(Name)\n#endblock\n$(Name)\n",
+				"doc.html": "#extends layout.html\n#define $(Name) doc\n" +
+					"#block title\n$(Name)\n#endblock\n",
+			},
+			output: "doc\ndoc\n"},
+		{name: "prepend and append",
+			files: map[string]string{
+				"layout.html": layout,
+				"head.html":   "head\n",
+				"foot.html":   "foot\n",
+				"doc.html": "#extends layout.html\n#prepend head.html\n" +
+					"#append foot.html\n#block title\nAbout\n#endblock\n",
+			},
+			output: "head\n<title>\nAbout\n</title>\n<main>\nNothing here yet.\n" +
+				"</main>\nfoot\n"},
+		{name: "same name twice",
+			files: map[string]string{
+				"doc.html": "#block a\n#endblock\n#block a\n#endblock\n",
+			},
+			fails: errDuplicateBlock},
+		{name: "invalid name",
+			files: map[string]string{
+				"doc.html": "#block a.b\n#endblock\n",
+			},
+			fails: "#block has an invalid name"},
+		{name: "never ended",
+			files: map[string]string{
+				"doc.html": "#block a\ntext\n",
+			},
+			fails: errUnterminatedBlock},
+		{name: "more than one layout",
+			files: map[string]string{
+				"layout.html": layout,
+				"doc.html":    "#extends layout.html\n#extends layout.html\n",
+			},
+			fails: "document can only #extends one layout"},
+		{name: "circular",
+			files: map[string]string{
+				"layout.html": "#extends doc.html\n",
+				"doc.html":    "#extends layout.html\n",
+			},
+			fails: "circular"},
+	}
+	for _, test := range tests {
+		c := newTestCompiler()
+		out, err := compileFiles(t, c, test.files, "doc.html", nil)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v (%q)", test.name, test.fails,
+					err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
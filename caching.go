@@ -6,6 +6,9 @@ import (
 	"io"
 )
 
+// Deprecated: variables are no longer limited to 64 bytes, they can be as
+// long as the Compiler's MaxVariableLength (DefaultMaxVariableLength unless
+// it was changed).
 const MaxVariableLength = 64
 
 type Cache interface {
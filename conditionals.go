@@ -0,0 +1,193 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"io/ioutil"
+	"strings"
+)
+
+// keywords used in the arguments of #if and #elif
+const ConditionNot = "!"
+const ConditionDefined = "defined"
+const ConditionInput = "input"
+const ConditionEqual = "=="
+const ConditionNotEqual = "!="
+
+// the different kinds of conditions
+const (
+	// defined $(Name)
+	conditionDefined = iota
+	// input name
+	conditionInput
+	// $(Name), $(Name) == value, $(Name) != value
+	conditionValue
+)
+
+// conditional is a parsed #if, #ifdef, #ifndef, #elif, #else or #endif.
+// Each one in a block points to the next, starting from the #if and ending
+// with the #endif.
+type conditional struct {
+	pos *macoPos
+
+	kind     int
+	negate   bool
+	variable variablePos // used by conditionDefined and conditionValue
+	input    string      // used by conditionInput
+	operator string      // used by conditionValue. "" means 'is not empty'
+	value    string      // used by conditionValue
+
+	// the next #elif, #else, or #endif of the block. nil if this is the
+	// #endif.
+	next *conditional
+
+	// the #endif of the block.
+	end *macoPos
+}
+
+// returns the last #elif, #else, or #endif found so far in the block
+func (cond *conditional) lastBranch() *conditional {
+	for cond.next != nil {
+		cond = cond.next
+	}
+	return cond
+}
+
+// parses the arguments of an #if, #ifdef, #ifndef or #elif macro.
+func parseCondition(m *macoPos, delims Delimiters) (cond *conditional,
+	oerr *Error) {
+	cond = &conditional{pos: m}
+	args := append([]string{}, m.args[1:]...)
+	switch m.args[0] {
+	case IfdefStr:
+		args = append([]string{ConditionDefined}, args...)
+	case IfndefStr:
+		args = append([]string{ConditionNot + ConditionDefined}, args...)
+	}
+
+	unknown := func(because *Error) *Error {
+		oerr := NewError(errUnknownCondition)
+		oerr.SetSubjectf("%s '%s' %s", m.args[0], strings.Join(m.args[1:], " "),
+			m.ToString())
+		if because != nil {
+			oerr.SetBecause(because)
+		}
+		return oerr
+	}
+
+	// negation can either be its own argument or be in front of the first.
+	if len(args) != 0 && strings.HasPrefix(args[0], ConditionNot) &&
+		args[0] != ConditionNotEqual {
+		cond.negate = true
+		args[0] = args[0][len(ConditionNot):]
+		if args[0] == "" {
+			args = args[1:]
+		}
+	}
+
+	var variable string
+	switch {
+	case len(args) == 2 && args[0] == ConditionDefined:
+		cond.kind = conditionDefined
+		variable = args[1]
+	case len(args) == 2 && args[0] == ConditionInput:
+		cond.kind = conditionInput
+		cond.input = args[1]
+		return cond, nil
+	case len(args) == 1:
+		cond.kind = conditionValue
+		variable = args[0]
+	case len(args) >= 3 && (args[1] == ConditionEqual || args[1] == ConditionNotEqual):
+		cond.kind = conditionValue
+		variable = args[0]
+		cond.operator = args[1]
+		cond.value = strings.Join(args[2:], string(MacroArgument))
+	default:
+		return cond, unknown(nil)
+	}
+
+	pos, serr := scanVariable([]byte(variable), 0, delims)
+	if serr != nil {
+		return cond, unknown(serr)
+	}
+	if int(pos.length) != len(variable) || pos.escaped {
+		return cond, unknown(nil)
+	}
+	cond.variable = pos
+	return cond, nil
+}
+
+// evaluates the condition during the Output Phase.
+func (c *nonConvertedFile) evaluate(cond *conditional) (bool, error) {
+	var ok bool
+	switch cond.kind {
+	case conditionDefined:
+		ok = c.isDefined(cond.variable)
+	case conditionInput:
+		_, ok = c.sourceDocument.compRequest.allInput[cond.input]
+	case conditionValue:
+		value, err := c.definitionString(cond.variable)
+		if err != nil {
+			return false, err
+		}
+		switch cond.operator {
+		case ConditionEqual:
+			ok = value == cond.value
+		case ConditionNotEqual:
+			ok = value != cond.value
+		default:
+			ok = value != ""
+		}
+	}
+	ok = ok != cond.negate
+	Logger.Debugf("%s %s evaluated to %t in %s", cond.pos.args[0],
+		cond.pos.ToString(), ok, c.sourceDocument.path)
+	return ok, nil
+}
+
+// reads the entire definition of the variable at pos into a string. Nested
+// variables in normal definitions will be defined as well. A variable that
+// isn't defined is treated as "".
+func (c *nonConvertedFile) definitionString(pos variablePos) (string, error) {
+	def, nested, derr := c.define(pos)
+	if derr != nil {
+		if oerr, ok := derr.(*Error); ok {
+			switch oerr.ErrStr {
+			case errNoProcessor, errNotDefined, errNotDefinedInProcessor:
+				Logger.Debugf("%s - %s", pos, derr)
+				return pos.fallback, nil
+			}
+		}
+		return "", derr
+	}
+
+	// just like when reading, normal definitions can have variables of
+	// their own and processor definitions cannot.
+	var src vorlageproc.Definition = def
+	if nested {
+		src = c.nestedReader(def, pos)
+	}
+	if len(pos.filters) != 0 {
+		filtered, ferr := newFilteredDefinition(src, pos.filters)
+		if ferr != nil {
+			ferr.SetSubjectf("%s in %s", ferr.Subject, pos.rawText)
+			return "", ferr
+		}
+		src = filtered
+	}
+	*c.definitionStack = append(*c.definitionStack, pos.fullName)
+	value, err := ioutil.ReadAll(src)
+	*c.definitionStack = (*c.definitionStack)[:len(*c.definitionStack)-1]
+	if err != nil {
+		if _, ok := err.(*Error); ok {
+			return "", err
+		}
+		oerr := NewError(errFailedToReadVariable)
+		oerr.SetSubject(pos.fullName)
+		oerr.SetBecause(NewError(err.Error()))
+		return "", oerr
+	}
+	if !nested {
+		_ = def.Close()
+	}
+	return string(value), nil
+}
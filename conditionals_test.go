@@ -0,0 +1,171 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"strings"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		line     string
+		kind     int
+		negate   bool
+		variable string // fullName
+		input    string
+		operator string
+		value    string
+		fails    bool
+	}{
+		{line: "#if defined $(Name)", kind: conditionDefined,
+			variable: "$(Name)"},
+		{line: "#if !defined $(Name)", kind: conditionDefined, negate: true,
+			variable: "$(Name)"},
+		{line: "#if ! defined $(Name)", kind: conditionDefined, negate: true,
+			variable: "$(Name)"},
+		{line: "#ifdef $(p.Name)", kind: conditionDefined,
+			variable: "$(p.Name)"},
+		{line: "#ifndef $(Name)", kind: conditionDefined, negate: true,
+			variable: "$(Name)"},
+		{line: "#if input page", kind: conditionInput, input: "page"},
+		{line: "#elif !input page", kind: conditionInput, negate: true,
+			input: "page"},
+		{line: "#if $(Name)", kind: conditionValue, variable: "$(Name)"},
+		{line: "#if $(Role) == admin", kind: conditionValue,
+			variable: "$(Role)", operator: ConditionEqual, value: "admin"},
+		{line: "#if $(Role) != super  user", kind: conditionValue,
+			variable: "$(Role)", operator: ConditionNotEqual,
+			value: "super user"},
+		{line: `#if $(Role) == "super  user"`, kind: conditionValue,
+			variable: "$(Role)", operator: ConditionEqual,
+			value: "super  user"},
+		{line: "#if !$(Name) == a", kind: conditionValue, negate: true,
+			variable: "$(Name)", operator: ConditionEqual, value: "a"},
+		{line: "#ifdef DEBUG", fails: true},
+		{line: "#if", fails: true},
+		{line: "#if defined", fails: true},
+		{line: "#if $(Name) is a", fails: true},
+		{line: "#if $(Name)x", fails: true},
+		{line: "#if $$(Name)", fails: true},
+		{line: "#if input", fails: true},
+	}
+	for _, test := range tests {
+		args, starts, _, err := splitMacroArguments(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		m := &macoPos{args: args, argStarts: starts, line: test.line}
+		cond, err := parseCondition(m, DefaultDelimiters)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.line)
+			} else if err.ErrStr != errUnknownCondition {
+				t.Errorf("%s: expected %q, got %s", test.line,
+					errUnknownCondition, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if cond.kind != test.kind || cond.negate != test.negate ||
+			cond.variable.fullName != test.variable ||
+			cond.input != test.input || cond.operator != test.operator ||
+			cond.value != test.value {
+			t.Errorf("%s: got %d %v %q %q %q %q", test.line, cond.kind,
+				cond.negate, cond.variable.fullName, cond.input,
+				cond.operator, cond.value)
+		}
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	proc := &testProcessor{
+		info: vorlageproc.ProcessorInfo{
+			Name: "p",
+			Variables: []vorlageproc.ProcessorVariable{
+				{Name: "Role"},
+				{Name: "Empty"},
+			},
+		},
+		defines: map[string]func(vorlageproc.DefineInfo) vorlageproc.Definition{
+			"Role": func(vorlageproc.DefineInfo) vorlageproc.Definition {
+				return &NormalDefinition{value: "admin"}
+			},
+			"Empty": func(vorlageproc.DefineInfo) vorlageproc.Definition {
+				return &NormalDefinition{}
+			},
+		},
+	}
+	tests := []struct {
+		name   string
+		doc    string
+		input  map[string]string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "ifdef",
+			doc:    "#define $(A) a\n#ifdef $(A)\nyes\n#else\nno\n#endif\n",
+			output: "yes\n"},
+		{name: "ifndef",
+			doc:    "#ifndef $(A)\nyes\n#endif\nafter\n",
+			output: "yes\nafter\n"},
+		{name: "processor variable is defined",
+			doc:    "#if defined $(p.Role)\nyes\n#endif\n#ifdef $(p.Nope)\nno\n#endif\n",
+			output: "yes\n"},
+		{name: "input",
+			doc:    "#if input page\npage $(page)\n#elif !input guest\nnobody\n#else\nguest\n#endif\n",
+			input:  map[string]string{"guest": ""},
+			output: "guest\n"},
+		{name: "processor value",
+			doc:    "#if $(p.Role) == user\nuser\n#elif $(p.Role) == admin\nadmin\n#else\nnone\n#endif\n",
+			output: "admin\n"},
+		{name: "not equal",
+			doc:    "#if $(p.Role) != admin\nno\n#else\nyes\n#endif\n",
+			output: "yes\n"},
+		{name: "empty",
+			doc:    "#if $(p.Empty)\nno\n#elif !$(p.Empty)\nyes\n#endif\n",
+			output: "yes\n"},
+		{name: "nested definitions",
+			doc:    "#define $(A) $(B)!\n#define $(B) b\n#if $(A) == b!\nyes\n#endif\n",
+			output: "yes\n"},
+		{name: "undefined is empty",
+			doc:    "#if $(A)\nno\n#else\nyes\n#endif\n",
+			output: "yes\n"},
+		{name: "nested blocks",
+			doc:    "#ifdef $(A)\nno\n#else\n#if input x\nx\n#else\nnot x\n#endif\n#endif\ndone\n",
+			output: "not x\ndone\n"},
+		{name: "unknown condition",
+			doc:   "text\n#ifdef DEBUG\n#endif\n",
+			fails: errUnknownCondition},
+		{name: "never ended",
+			doc:   "#if input x\ntext\n",
+			fails: errUnterminatedBlock},
+		{name: "elif after else",
+			doc:   "#if input x\n#else\n#elif input y\n#endif\n",
+			fails: errUnmatchedBlock},
+		{name: "endif without if",
+			doc:   "text\n#endif\n",
+			fails: errUnmatchedBlock},
+	}
+	for _, test := range tests {
+		c := newTestCompiler(proc)
+		out, err := compileFiles(t, c, map[string]string{"doc.html": test.doc},
+			"doc.html", test.input)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.fails, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
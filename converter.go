@@ -33,6 +33,18 @@ type nonConvertedFile struct {
 	// the file to read, close, rewind.
 	sourceFile File
 
+	// the file that is reading sourceDocument (ie, with #include or
+	// #prepend), nil for the root document. The #local definitions of
+	// the documents being read through are looked at before the root's.
+	includer *nonConvertedFile
+
+	// what the variables in sourceFile start and end with.
+	delims Delimiters
+
+	// if not "", the filter used in place of the document's AutoEscape
+	// (see #redirect).
+	escapeFilter string
+
 	// used for drawParser
 	variableReadBuffer []byte
 
@@ -46,6 +58,33 @@ type nonConvertedFile struct {
 	// definitionStack will be used to check for circular definitions within
 	// nested normal definitions and will error out if it does detect one.
 	definitionStack *[]string
+
+	// the macros found in the content of sourceDocument (see
+	// Document.bodyPos). Reads from the source file will always stop at the
+	// next one so it can be ran. nil when reading a definition.
+	directives    []*macoPos
+	nextDirective int
+
+	// where the source file starts in the raw file. Used to find where
+	// the directives are relative to bytesRead.
+	contentStart int64
+
+	// the #foreach blocks that are currently being read, inner-most last.
+	scopes []*listScope
+
+	// the amount of scopes at the start of scopes that were given to
+	// this file by the file that's reading it (see nestedReader). They
+	// belong to that file, so they are not closed by this one.
+	inheritedScopes int
+
+	// whitespace at the end of what was last read from the source file
+	// that can't be outputted until we know it's not in front of a
+	// variable with a trim marker (see trimBeforeVariables).
+	trimHeld []byte
+
+	// true if the last variable had a trim marker at its end, the
+	// whitespace that comes after it is skipped.
+	trimNext bool
 }
 
 type osFileHandle struct {
@@ -100,13 +139,34 @@ func (m myconvert) Shutdown() error {
 
 var _ File = &nonConvertedFile{}
 
+// marks that doc is about to be read by reader (see
+// nonConvertedFile.includer).
+func (doc *Document) readBy(reader File) {
+	file, ok := doc.ConvertedFile.(*nonConvertedFile)
+	if !ok {
+		return
+	}
+	file.includer, _ = reader.(*nonConvertedFile)
+}
+
+// returns the file that is reading doc, nil if there isn't one.
+func (doc *Document) includer() *nonConvertedFile {
+	if file, ok := doc.ConvertedFile.(*nonConvertedFile); ok {
+		return file.includer
+	}
+	return nil
+}
+
 func (doc *Document) getConverted(sourceFile File) (converedFile File, err *Error) {
 	// todo: switch on the source file Name to find a good converted (haml->html)
 	file := nonConvertedFile{
 		sourceFile:         sourceFile,
 		sourceDocument:     doc,
-		variableReadBuffer: make([]byte, MaxVariableLength),
+		delims:             doc.delimiters,
+		variableReadBuffer: newVariableReadBuffer(doc.compiler.maxVariableLength()),
 		definitionStack:    new([]string),
+		directives:         doc.bodyPos,
+		contentStart:       doc.rawContentStart,
 	}
 	return &file, nil
 }
@@ -0,0 +1,108 @@
+package vorlage
+
+import "math"
+
+// definitionKind is which macro a normal definition was made with. When a
+// variable is defined more than once, the greater kind is kept.
+type definitionKind int
+
+// the depth of the Compiler's global definitions, they're further away
+// than any document (see Compiler.Globals).
+const globalsDepth = math.MaxInt32
+
+const (
+	kindDefault definitionKind = iota
+	kindDefine
+	kindOverride
+)
+
+var definitionKinds = map[string]definitionKind{
+	DefaultStr:  kindDefault,
+	DefineStr:   kindDefine,
+	MacroStr:    kindDefine,
+	OverrideStr: kindOverride,
+	LocalStr:    kindDefine,
+}
+
+// returns how many documents doc is away from the root document.
+func (doc *Document) depth() int {
+	var depth int
+	for d := doc; d.parent != nil; d = d.parent {
+		depth++
+	}
+	return depth
+}
+
+// returns true if d is to be kept over other (which has the same name).
+// ok is false if neither of them take precedence.
+func (d NormalDefinition) outranks(other NormalDefinition) (outranks bool,
+	ok bool) {
+	switch {
+	case d.kind != other.kind:
+		return d.kind > other.kind, true
+	case d.depth != other.depth:
+		// the document closest to the root wins.
+		return d.depth < other.depth, true
+	case d.kind == kindDefault:
+		// the first #default wins
+		return false, true
+	}
+	return false, false
+}
+
+// adds definition to defs (the definitions of the root document, or the
+// #local definitions of a document). If the variable has already been
+// defined in defs, the definition that takes precedence is kept:
+//
+//  1. #override over #define (or #macro) over #default
+//  2. the document closest to the root document
+//  3. the first #default
+//
+// If neither takes precedence (ie, the same document defines a variable
+// twice) errAlreadyDefined is returned.
+func addDefinition(defs *[]NormalDefinition,
+	definition NormalDefinition) *Error {
+	for i, d := range *defs {
+		if d.GetFullName() != definition.GetFullName() {
+			continue
+		}
+		outranks, ok := definition.outranks(d)
+		if !ok {
+			oerr := NewError(errAlreadyDefined)
+			oerr.SetSubjectf("%s by %s", d.GetFullName(), d.source)
+			return oerr
+		}
+		if outranks {
+			Logger.Debugf("%s defined by %s replaces the one by %s",
+				definition.GetFullName(), definition.source, d.source)
+			(*defs)[i] = definition
+		} else {
+			Logger.Debugf("%s defined by %s is ignored, the one by %s is kept",
+				definition.GetFullName(), definition.source, d.source)
+		}
+		return nil
+	}
+
+	Logger.Debugf("%s defined by %s", definition.GetFullName(),
+		definition.source)
+	*defs = append(*defs, definition)
+	return nil
+}
+
+// removes the definition of the variable (#undef) that was made by any
+// document loaded before this point, as well as this document's #local
+// definition of it. source is what removed it.
+func (doc *Document) removeDefinition(fullName string, source string) {
+	for _, defs := range []*[]NormalDefinition{&doc.localDefinitions,
+		doc.allDefinitions} {
+		for i, d := range *defs {
+			if d.GetFullName() != fullName {
+				continue
+			}
+			Logger.Debugf("%s defined by %s was removed by %s", fullName,
+				d.source, source)
+			*defs = append((*defs)[:i], (*defs)[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package vorlage
+
+import "testing"
+
+func TestAddDefinition(t *testing.T) {
+	def := func(kind definitionKind, depth int, value string) NormalDefinition {
+		return NormalDefinition{variable: "$(Name)", value: value,
+			kind: kind, depth: depth, source: value}
+	}
+	tests := []struct {
+		name  string
+		first NormalDefinition
+		then  NormalDefinition
+		kept  string
+		fails bool
+	}{
+		{name: "override over define",
+			first: def(kindDefine, 0, "a"), then: def(kindOverride, 2, "b"),
+			kept: "b"},
+		{name: "define over default",
+			first: def(kindDefine, 1, "a"), then: def(kindDefault, 0, "b"),
+			kept: "a"},
+		{name: "override over default",
+			first: def(kindOverride, 3, "a"), then: def(kindDefault, 0, "b"),
+			kept: "a"},
+		{name: "closest document",
+			first: def(kindDefine, 2, "a"), then: def(kindDefine, 1, "b"),
+			kept: "b"},
+		{name: "root over includes",
+			first: def(kindDefine, 1, "a"), then: def(kindDefine, 0, "b"),
+			kept: "b"},
+		{name: "document over globals",
+			first: def(kindDefine, globalsDepth, "a"),
+			then:  def(kindDefine, 5, "b"), kept: "b"},
+		{name: "closest override",
+			first: def(kindOverride, 0, "a"), then: def(kindOverride, 1, "b"),
+			kept: "a"},
+		{name: "first default",
+			first: def(kindDefault, 1, "a"), then: def(kindDefault, 1, "b"),
+			kept: "a"},
+		{name: "defined twice",
+			first: def(kindDefine, 0, "a"), then: def(kindDefine, 0, "b"),
+			fails: true},
+		{name: "overridden twice",
+			first: def(kindOverride, 1, "a"), then: def(kindOverride, 1, "b"),
+			fails: true},
+	}
+	for _, test := range tests {
+		other := NormalDefinition{variable: "$(Other)", value: "o"}
+		defs := []NormalDefinition{other}
+		if err := addDefinition(&defs, test.first); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		err := addDefinition(&defs, test.then)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(defs) != 2 || defs[0].value != "o" || defs[1].value != test.kept {
+			t.Errorf("%s: got %v, expected %s to be kept", test.name, defs,
+				test.kept)
+		}
+	}
+}
@@ -6,11 +6,12 @@ import (
 	"io"
 	"reflect"
 	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
 
-var validProcessorName = regexp.MustCompile(`^[a-z0-9_\-]+$`)
+var validProcessorName = regexp.MustCompile(`^` + NameRegexp + `$`)
 
 // will also delete any processors in any list that have nil
 func (c *Compiler) rebuildProcessors() (err error) {
@@ -109,6 +110,7 @@ func (c *Compiler) rebuildProcessors() (err error) {
 
 	c.processors = newlist
 	c.processorInfos = newlistinfo
+	c.resetChecked()
 
 	return nil
 }
@@ -152,6 +154,73 @@ type Compiler struct {
 
 	// used for watching go reloads if AutoReloadGoFiles
 	gowatcher *watcher
+
+	// if true, macros (such as #define, #include and #if) will also be
+	// recognised when found at the start of a line after the top of the
+	// document. These lines are removed from the output. Macros that are
+	// only of use in the content (#include, #if, #foreach, #block and
+	// #raw) need it. It's false by default so documents whose content has
+	// lines such as "#include <stdio.h>" are left as they are. Set it
+	// before calling Compile.
+	ContentMacros bool
+
+	// AutoEscape maps the ending of a requested document's file name (such
+	// as ".html") to the filter that definitions of processor variables
+	// will be read through when no filters were given to the variable.
+	// Definitions that implement RawDefinition can opt-out. It's nil
+	// (disabled) by default, set it to DefaultAutoEscape to enable it.
+	AutoEscape map[string]string
+
+	// Delimiters maps the ending of a document's file name (such as ".js")
+	// to what the variables in that document start and end with, for
+	// documents whose content clashes with $( and ). Documents that don't
+	// match any of them use DefaultDelimiters. Set it before calling
+	// Compile.
+	Delimiters map[string]Delimiters
+
+	// Globals are defined in every document that's compiled, keyed by the
+	// Variable Name (ie "SiteName" defines $(SiteName)). Documents can
+	// replace them by using #define. Set it before calling Compile.
+	Globals map[string]string
+
+	// GlobalsFile is the path to a file that's made up of #define's (and
+	// #macro's) that are defined the same way Globals are. The file is
+	// loaded again when it has been modified since the last Compile.
+	GlobalsFile string
+
+	// DocumentRoot is what includes (and the like) that start with a "/"
+	// are relative to (ie "#include /partials/header.html"). If it's set,
+	// documents outside of it and IncludePath can't be included. When it's
+	// "" they are relative to the document like any other.
+	DocumentRoot string
+
+	// IncludePath is a list of directories that are looked in, in order,
+	// for documents that were not found relative to the document that's
+	// including them (like -I for a C compiler).
+	IncludePath []string
+
+	// MaxVariableLength is the longest a variable (including its prefix and
+	// suffix) can be. Anything longer that looks like a variable is
+	// outputted as it was written. NewCompiler sets this to
+	// DefaultMaxVariableLength.
+	MaxVariableLength int
+
+	globals   globalDefinitions
+	globalsMu sync.Mutex
+
+	// the documents checkVariables has found nothing wrong with, keyed by
+	// their inode.
+	checked   map[uint64]checkedFile
+	checkedMu sync.Mutex
+}
+
+// the MaxVariableLength NewCompiler gives to Compilers.
+const DefaultMaxVariableLength = 4096
+
+// the AutoEscape that is recommended for Compilers.
+var DefaultAutoEscape = map[string]string{
+	".html":      "html",
+	".proc.json": "json",
 }
 
 type compileRequest struct {
@@ -164,6 +233,10 @@ type compileRequest struct {
 
 	// associative array with compiler.vorlageproc
 	processorRInfos []vorlageproc.RequestInfo
+
+	// what the root document's definitions start off as (see
+	// Compiler.Globals).
+	globals []NormalDefinition
 }
 
 func (c compileRequest) String() string {
@@ -214,6 +287,30 @@ func (c compileRequest) String() string {
 	return str
 }
 
+// returns the Delimiters used by the document at path (see
+// Compiler.Delimiters).
+func (c *Compiler) delimitersFor(path string) Delimiters {
+	var ending string
+	delims := DefaultDelimiters
+	for k, v := range c.Delimiters {
+		// the longest ending wins (ie .min.js over .js)
+		if strings.HasSuffix(path, k) && len(k) > len(ending) &&
+			v.Prefix != "" && v.Suffix != "" {
+			ending, delims = k, v
+		}
+	}
+	return delims
+}
+
+// returns Compiler.MaxVariableLength, or DefaultMaxVariableLength if it
+// wasn't set.
+func (c *Compiler) maxVariableLength() int {
+	if c.MaxVariableLength <= 0 {
+		return DefaultMaxVariableLength
+	}
+	return c.MaxVariableLength
+}
+
 // see https://github.com/golang/go/issues/20461
 var AutoReloadGoFiles bool = false
 
@@ -222,6 +319,7 @@ func NewCompiler() (c *Compiler, err error) {
 
 	// structure set up
 	c = new(Compiler)
+	c.MaxVariableLength = DefaultMaxVariableLength
 
 	// load the go processors
 	c.goprocessors, err = loadGoProcessors(GoPluginLoadPath)
@@ -297,8 +395,9 @@ type CompileStatus struct {
 	// together
 	Err error
 
-	// if true, the error was because of a processor's action, meaning the
-	// ActionHandler's relevant function would have been invoked.
+	// if true, the error was because of a processor's action (or the
+	// request's input, see #input), meaning the ActionHandler's relevant
+	// function would have been invoked.
 	// If false (and Err is non-nil), then something happened when trying to
 	// compile the document itself.
 	WasProcessor bool
@@ -328,6 +427,34 @@ type ActionHandler interface {
 	ActionHTTPHeader(header string)
 }
 
+// BadRequestHandler can be implemented by an ActionHandler to be told when
+// the input given to a document is missing or invalid (see #input). If it
+// isn't implemented, ActionCritical is used instead.
+type BadRequestHandler interface {
+	// ActionBadRequest should tell the requestor that the input they gave
+	// is missing or invalid as described by err.
+	ActionBadRequest(err error)
+}
+
+// StatusHandler can be implemented by an ActionHandler to be told the status
+// code a document wants to respond with (see #status). If it isn't
+// implemented, the status code is ignored.
+type StatusHandler interface {
+	// ActionStatus is relivent only to http server/requestors. If called,
+	// the response to the compRequest must have this status code (such as
+	// 410) instead of a successful one.
+	ActionStatus(code int)
+}
+
+// RedirectHandler can be implemented by an ActionHandler to be told the
+// status code of a #redirect. If it isn't implemented, ActionSee is used
+// instead.
+type RedirectHandler interface {
+	// ActionRedirect is the same as ActionSee but the requestor is told with
+	// the status code given (such as 301).
+	ActionRedirect(path string, code int)
+}
+
 /*
  * The best way to describe this function is by reading through the steps
  * defined in the 'Highlevel Process' chapter in the readme.
@@ -368,6 +495,13 @@ func (comp *Compiler) Compile(filepath string, allInput map[string]string,
 			comp.shutdownCompilers0 <- true
 		}
 	}()
+	// inputs may be given defaults by the document (see
+	// Document.defaultInputs), which mustn't change the caller's map.
+	input := make(map[string]string, len(allInput))
+	for k, v := range allInput {
+		input[k] = v
+	}
+	allInput = input
 	compReq := compileRequest{
 		compiler:        comp,
 		filepath:        filepath,
@@ -379,6 +513,14 @@ func (comp *Compiler) Compile(filepath string, allInput map[string]string,
 	}
 	Logger.Debugf("new request generated: %s", compReq)
 
+	globals, gerr := comp.currentGlobals()
+	if gerr != nil {
+		erro := NewError("failed to load global definitions")
+		erro.SetBecause(gerr)
+		return nil, CompileStatus{erro, false}
+	}
+	compReq.globals = globals
+
 	for i := range comp.processors {
 		req := vorlageproc.RequestInfo{}
 		req.Filepath = filepath
@@ -449,7 +591,47 @@ func (comp *Compiler) Compile(filepath string, allInput map[string]string,
 		erro.SetBecause(errd)
 		return docstream, CompileStatus{erro, false}
 	}
+	// the processors were given the request as it was, the inputs the
+	// document declares (#input) are given their defaults for the rest of it.
+	doc.defaultInputs(allInput)
+
+	// the inputs are only checked once the processors had the chance to
+	// deny the request.
+	if ierr := doc.checkInputs(allInput); ierr != nil {
+		_ = doc.Close()
+		erro := NewError("document was given invalid input")
+		erro.SetSubject(filepath)
+		erro.SetBecause(ierr)
+		if handler, ok := actionsHandler.(BadRequestHandler); ok {
+			handler.ActionBadRequest(ierr)
+		} else {
+			actionsHandler.ActionCritical(ierr)
+		}
+		return nil, CompileStatus{erro, true}
+	}
+
+	// a #redirect is handled the same way as a processor's ActionSee.
+	if rdoc, redirect := doc.findRedirect(); redirect != nil {
+		target, rerr := rdoc.redirectTarget(redirect)
+		_ = doc.Close()
+		if rerr != nil {
+			erro := NewError("failed to define the #redirect target")
+			erro.SetSubjectf("%s %s", rdoc.path, redirect.pos.ToString())
+			erro.SetBecause(NewError(rerr.Error()))
+			return nil, CompileStatus{erro, false}
+		}
+		erro := NewError("document redirect")
+		erro.SetSubjectf("%s redirecting compRequest to %s", rdoc.path, target)
+		if handler, ok := actionsHandler.(RedirectHandler); ok {
+			handler.ActionRedirect(target, redirect.status)
+		} else {
+			actionsHandler.ActionSee(target)
+		}
+		return nil, CompileStatus{erro, true}
+	}
 
+	// now the documents can respond (#status, #header, #contenttype)
+	doc.runResponseMacros(actionsHandler)
 	return doc, CompileStatus{}
 }
 
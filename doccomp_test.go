@@ -0,0 +1,136 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testProcessor is a processor that's given to the Compilers made by
+// newTestCompiler. Its variables are defined by the functions in defines
+// (keyed by the variable's name).
+type testProcessor struct {
+	info    vorlageproc.ProcessorInfo
+	defines map[string]func(vorlageproc.DefineInfo) vorlageproc.Definition
+	actions []vorlageproc.Action // returned by OnRequest
+}
+
+func (p *testProcessor) Startup() (vorlageproc.ProcessorInfo, error) {
+	return p.info, nil
+}
+
+func (p *testProcessor) OnRequest(vorlageproc.RequestInfo,
+	*interface{}) []vorlageproc.Action {
+	return p.actions
+}
+
+func (p *testProcessor) DefineVariable(info vorlageproc.DefineInfo,
+	_ interface{}) vorlageproc.Definition {
+	return p.defines[p.info.Variables[info.ProcVarIndex].Name](info)
+}
+
+func (p *testProcessor) OnFinish(vorlageproc.RequestInfo, interface{}) {
+}
+
+func (p *testProcessor) Shutdown() error {
+	return nil
+}
+
+// returns a compiler for the tests (without loading any processors from
+// disk) that has ContentMacros set and is given procs.
+func newTestCompiler(procs ...*testProcessor) *Compiler {
+	c := &Compiler{
+		ContentMacros:     true,
+		MaxVariableLength: DefaultMaxVariableLength,
+	}
+	for _, p := range procs {
+		c.processors = append(c.processors, p)
+		c.processorInfos = append(c.processorInfos, p.info)
+	}
+	return c
+}
+
+// testActions is an ActionHandler that writes down every action it's given.
+type testActions struct {
+	actions []string
+}
+
+func (a *testActions) ActionCritical(err error) {
+	a.actions = append(a.actions, fmt.Sprintf("critical %s", err))
+}
+
+func (a *testActions) ActionAccessFail(err error) {
+	a.actions = append(a.actions, fmt.Sprintf("accessfail %s", err))
+}
+
+func (a *testActions) ActionSee(path string) {
+	a.actions = append(a.actions, "see "+path)
+}
+
+func (a *testActions) ActionHTTPHeader(header string) {
+	a.actions = append(a.actions, "header "+header)
+}
+
+// writes files (keyed by their path) to a new directory and compiles the
+// one at path with c. Returns what was outputted.
+func compileFiles(t *testing.T, c *Compiler, files map[string]string,
+	path string, input map[string]string) (string, error) {
+	dir, err := ioutil.TempDir("", "vorlage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if input == nil {
+		input = map[string]string{}
+	}
+	doc, status := c.Compile(filepath.Join(dir, path), input, nil,
+		&testActions{})
+	if status.Err != nil {
+		return "", status.Err
+	}
+	defer doc.Close()
+	out, err := ioutil.ReadAll(doc)
+	return string(out), err
+}
+
+func TestCompileOnRequestFirst(t *testing.T) {
+	// processors are given the request before the document is loaded, so
+	// one that denies access does so even if the document is broken.
+	proc := &testProcessor{actions: []vorlageproc.Action{{
+		Action: vorlageproc.ActionAccessFail,
+		Data:   []byte("log in first"),
+	}}}
+	dir, err := ioutil.TempDir("", "vorlage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "doc.html")
+	err = ioutil.WriteFile(path, []byte("#input q required\n#include nope.html\n"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := &testActions{}
+	_, status := newTestCompiler(proc).Compile(path, map[string]string{}, nil,
+		actions)
+	if status.Err == nil || !status.WasProcessor {
+		t.Errorf("expected the processor to deny access, got %v", status.Err)
+	}
+	if len(actions.actions) != 1 ||
+		actions.actions[0] != "accessfail log in first" {
+		t.Errorf("got the actions %q", actions.actions)
+	}
+}
@@ -79,6 +79,8 @@ const (
 	errDoubleInputStream            = "the same streamed input was requested twice in the same compRequest"
 	errResetVariable                = "failed to reset variable"
 	errAlreadyDefined               = "variable has already been defined"
+	errMissingInput                 = "required input was not given"
+	errInvalidInput                 = "input does not match its pattern"
 	errVariableTooLong              = "variable too long"
 	errVariableMissingSuffix        = "'$(' detected but no ')'"
 	errVariableMissingPrefix        = "'$(' not detected"
@@ -87,4 +89,18 @@ const (
 	errVariableName                 = "variable has an invalid Name"
 	errBadReservedInput             = "reserved input not formatted correctly"
 	errCircularDefinition           = "circular definition detected"
+	errUnknownCondition             = "unknown condition"
+	errUnmatchedBlock               = "block macro has no matching start"
+	errUnterminatedBlock            = "block macro was never ended"
+	errNotAList                     = "variable is not a list"
+	errUnterminatedQuote            = "macro argument has an unterminated quote"
+	errUnterminatedHeredoc          = "multi-line macro argument was never ended"
+	errUnknownFilter                = "unknown filter"
+	errFilterName                   = "filter has an invalid name"
+	errNotAMacro                    = "arguments given to a variable that is not a #macro"
+	errMacroArguments               = "too many arguments given to #macro"
+	errDuplicateBlock               = "a #block with the same name already exists"
+	errInputArgument                = "processor variable arguments must be written as name=value"
+	errUnknownInput                 = "argument is not an input of the processor variable"
+	errOutsideRoots                 = "document is outside of the document root and include path"
 )
@@ -0,0 +1,498 @@
+package vorlage
+
+import (
+	"bufio"
+	"bytes"
+	vorlageproc "ellem.so/vorlageproc"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const VariableFilterSeporator = ":"
+const FilterRegexp = `^[a-zA-Z0-9]+$`
+
+var filterRegexpProc = regexp.MustCompile(FilterRegexp)
+
+// the amount of bytes read from a definition at a time when it's being
+// filtered.
+const filterReadLength = 1024
+
+// Filter creates a writer that transforms everything written to it before
+// writing it to dest. Close will be called once the definition has been read
+// entirely, anything the writer was holding on to must be written to dest
+// by then.
+type Filter func(dest io.Writer) io.WriteCloser
+
+// the filters that can be used by variables (ie $(Variable:html)).
+var filters = map[string]Filter{
+	"raw":   rawFilter,
+	"html":  RuneFilter(escapeHTML),
+	"url":   RuneFilter(escapeURL),
+	"js":    RuneFilter(escapeJS),
+	"json":  RuneFilter(escapeJSON),
+	"upper": RuneFilter(toUpper),
+	"lower": RuneFilter(toLower),
+}
+
+// filters can be registered while documents are being compiled.
+var filtersMutex sync.RWMutex
+
+// RegisterFilter makes filter available to variables by using
+// $(Variable:name). A filter that was already registered with the same name
+// (including the built in ones) will be replaced. It's safe to register
+// filters while documents are being compiled.
+func RegisterFilter(name string, filter Filter) error {
+	if !filterRegexpProc.MatchString(name) {
+		oerr := NewError(errFilterName)
+		oerr.SetSubjectf("'%s'", name)
+		return oerr
+	}
+	filtersMutex.Lock()
+	filters[name] = filter
+	filtersMutex.Unlock()
+	return nil
+}
+
+// returns the filter that was registered as name.
+func findFilter(name string) (filter Filter, ok bool) {
+	filtersMutex.RLock()
+	filter, ok = filters[name]
+	filtersMutex.RUnlock()
+	return filter, ok
+}
+
+// RuneFilter creates a Filter that replaces every UTF-8 character (r) with
+// what escape returns. raw is the bytes that make up r. Invalid UTF-8 is
+// handed to escape one byte at a time as utf8.RuneError.
+func RuneFilter(escape func(r rune, raw []byte) string) Filter {
+	return func(dest io.Writer) io.WriteCloser {
+		return &runeWriter{dest: dest, escape: escape}
+	}
+}
+
+// the raw filter doesn't do anything. It's used to stop AutoEscape.
+func rawFilter(dest io.Writer) io.WriteCloser {
+	return nopWriteCloser{dest}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type runeWriter struct {
+	dest   io.Writer
+	escape func(r rune, raw []byte) string
+
+	// the start of a character that has been split between writes.
+	partial []byte
+}
+
+func (w *runeWriter) Write(p []byte) (int, error) {
+	buf := append(w.partial, p...)
+	var out strings.Builder
+	var i int
+	for i < len(buf) && utf8.FullRune(buf[i:]) {
+		r, size := utf8.DecodeRune(buf[i:])
+		out.WriteString(w.escape(r, buf[i:i+size]))
+		i += size
+	}
+	w.partial = append([]byte{}, buf[i:]...)
+	_, err := io.WriteString(w.dest, out.String())
+	return len(p), err
+}
+
+func (w *runeWriter) Close() error {
+	// if there's anything left over, it was never a full character.
+	var out strings.Builder
+	for i := range w.partial {
+		out.WriteString(w.escape(utf8.RuneError, w.partial[i:i+1]))
+	}
+	w.partial = nil
+	_, err := io.WriteString(w.dest, out.String())
+	return err
+}
+
+func escapeHTML(r rune, raw []byte) string {
+	switch r {
+	case '&':
+		return "&amp;"
+	case '<':
+		return "&lt;"
+	case '>':
+		return "&gt;"
+	case '"':
+		return "&#34;"
+	case '\'':
+		return "&#39;"
+	}
+	return string(raw)
+}
+
+func escapeURL(r rune, raw []byte) string {
+	return url.QueryEscape(string(raw))
+}
+
+// escapes for the inside of a javascript string literal. Characters that
+// could end a <script> tag are escaped as well.
+func escapeJS(r rune, raw []byte) string {
+	switch r {
+	case '\\':
+		return `\\`
+	case '\'':
+		return `\'`
+	case '"':
+		return `\"`
+	case '`', '<', '>', '&', '=', '\u2028', '\u2029':
+		return fmt.Sprintf(`\u%04X`, r)
+	case '\n':
+		return `\n`
+	case '\r':
+		return `\r`
+	case '\t':
+		return `\t`
+	}
+	if r < 0x20 {
+		return fmt.Sprintf(`\u%04X`, r)
+	}
+	return string(raw)
+}
+
+// escapes for the inside of a json string.
+func escapeJSON(r rune, raw []byte) string {
+	switch r {
+	case '\\':
+		return `\\`
+	case '"':
+		return `\"`
+	case '<', '>', '&', '\u2028', '\u2029':
+		return fmt.Sprintf(`\u%04x`, r)
+	case '\n':
+		return `\n`
+	case '\r':
+		return `\r`
+	case '\t':
+		return `\t`
+	case utf8.RuneError:
+		return `\ufffd`
+	}
+	if r < 0x20 {
+		return fmt.Sprintf(`\u%04x`, r)
+	}
+	return string(raw)
+}
+
+func toUpper(r rune, raw []byte) string {
+	if r == utf8.RuneError {
+		return string(raw)
+	}
+	return string(unicode.ToUpper(r))
+}
+
+func toLower(r rune, raw []byte) string {
+	if r == utf8.RuneError {
+		return string(raw)
+	}
+	return string(unicode.ToLower(r))
+}
+
+// filteredDefinition is a definition that is read through a chain of
+// filters. The first filter is given the definition, the second filter is
+// given what the first filter wrote, and so on.
+type filteredDefinition struct {
+	def     vorlageproc.Definition
+	filters []Filter
+
+	// writers[0] is written to by the definition, and the last writer
+	// writes to out.
+	writers []io.WriteCloser
+	out     bytes.Buffer
+	buf     []byte
+	done    bool
+}
+
+var _ vorlageproc.Definition = &filteredDefinition{}
+
+// wraps def so that it is read through the filters named.
+func newFilteredDefinition(def vorlageproc.Definition,
+	names []string) (*filteredDefinition, *Error) {
+	f := &filteredDefinition{
+		def:     def,
+		filters: make([]Filter, len(names)),
+		buf:     make([]byte, filterReadLength),
+	}
+	for i, name := range names {
+		filter, ok := findFilter(name)
+		if !ok {
+			oerr := NewError(errUnknownFilter)
+			oerr.SetSubjectf("'%s'", name)
+			return nil, oerr
+		}
+		f.filters[i] = filter
+	}
+	f.start()
+	return f, nil
+}
+
+// (re)creates the chain of writers.
+func (f *filteredDefinition) start() {
+	f.out.Reset()
+	f.done = false
+	f.writers = make([]io.WriteCloser, len(f.filters))
+	var dest io.Writer = &f.out
+	for i := len(f.filters) - 1; i >= 0; i-- {
+		f.writers[i] = f.filters[i](dest)
+		dest = f.writers[i]
+	}
+}
+
+func (f *filteredDefinition) Read(p []byte) (int, error) {
+	for f.out.Len() == 0 && !f.done {
+		n, err := f.def.Read(f.buf)
+		if n > 0 {
+			if _, werr := f.writers[0].Write(f.buf[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+		if err == io.EOF {
+			// closing each writer (in order) flushes it into the next one.
+			for _, w := range f.writers {
+				if cerr := w.Close(); cerr != nil {
+					return 0, cerr
+				}
+			}
+			f.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n, _ := f.out.Read(p)
+	if f.done && f.out.Len() == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *filteredDefinition) Reset() error {
+	err := f.def.Reset()
+	if err != nil {
+		return err
+	}
+	f.start()
+	return nil
+}
+
+func (f *filteredDefinition) Close() error {
+	return f.def.Close()
+}
+
+// RawDefinition is a vorlageproc.Definition that can tell the Compiler that
+// it is trusted, meaning it will not be escaped by Compiler.AutoEscape.
+// Processors written in Go only need to give their Definition the Raw method
+// (they don't need to import this package). Processors written in C can
+// define vorlage_proc_definer_raw.
+type RawDefinition interface {
+	vorlageproc.Definition
+
+	// Raw returns true if the definition's contents are to be outputted as
+	// they are.
+	Raw() bool
+}
+
+// returns the filter that def is to be read through if the variable was not
+// given any filters, depending on the root document's file name (see
+// Compiler.AutoEscape). "" is returned if def should be left alone.
+func (doc *Document) autoEscapeFilter(def vorlageproc.Definition) string {
+	if raw, ok := def.(RawDefinition); ok && raw.Raw() {
+		return ""
+	}
+	var ending, filter string
+	for k, v := range doc.compiler.AutoEscape {
+		// the longest ending wins (ie .proc.json over .json)
+		if strings.HasSuffix(doc.root.path, k) && len(k) > len(ending) {
+			ending, filter = k, v
+		}
+	}
+	return filter
+}
+
+// same as Document.autoEscapeFilter unless c was given its own.
+func (c *nonConvertedFile) autoEscapeFilter(def vorlageproc.Definition) string {
+	if c.escapeFilter == "" {
+		return c.sourceDocument.autoEscapeFilter(def)
+	}
+	if raw, ok := def.(RawDefinition); ok && raw.Raw() {
+		return ""
+	}
+	return c.escapeFilter
+}
+
+// helper-function for loadDocumentFromPath
+// goes through the entire document looking for variables that use filters
+// that have not been registered (see RegisterFilter), or processor variables
+// that were given arguments that aren't their input. #raw's are skipped.
+// The inline includes that are found are added to doc.inlinePaths.
+// Documents that haven't changed since they were last checked are not
+// looked at again.
+func (doc *Document) checkVariables() *Error {
+	info, serr := doc.rawFile.Stat()
+	if serr != nil {
+		oerr := NewError("failed to stat file")
+		oerr.SetBecause(NewError(serr.Error()))
+		return oerr
+	}
+	max := doc.compiler.maxVariableLength()
+	checked := checkedFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		delims:  doc.delimiters,
+		max:     max,
+	}
+	if paths, ok := doc.compiler.checkedBefore(doc.fileInode, checked); ok {
+		for _, p := range paths {
+			doc.addInlinePath(p)
+		}
+		return nil
+	}
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(doc.rawFile, 0,
+		math.MaxInt64), max*2)
+	var linenum uint = 1
+	var at int64 = -1
+	for {
+		b, err := reader.ReadByte()
+		at++
+		if err == io.EOF {
+			checked.inlinePaths = doc.inlinePaths
+			doc.compiler.setChecked(doc.fileInode, checked)
+			return nil
+		}
+		if err != nil {
+			oerr := &Error{}
+			oerr.ErrStr = errFailedToReadBytes
+			oerr.SetBecause(NewError(err.Error()))
+			return oerr
+		}
+		if b == EndOfLine[0] {
+			linenum++
+			continue
+		}
+		if b != doc.delimiters.Prefix[0] {
+			continue
+		}
+
+		// it's possible the variable starts here. Take a look without moving
+		// forward.
+		peek, _ := reader.Peek(max - 1)
+		pos, serr := scanVariable(append([]byte{b}, peek...), 0,
+			doc.delimiters)
+		if serr != nil || doc.isVerbatim(at) {
+			continue
+		}
+		if pos.escaped {
+			// don't look at the variable that's being escaped.
+			skipped, _ := reader.Discard(int(pos.length) - 1)
+			at += int64(skipped)
+			linenum += uint(strings.Count(pos.rawText, EndOfLine))
+			continue
+		}
+		if pos.include != "" {
+			// it's loaded along with the document's other includes.
+			doc.addInlinePath(pos.include)
+			continue
+		}
+		for _, name := range pos.filters {
+			if _, ok := findFilter(name); !ok {
+				oerr := NewError(errUnknownFilter)
+				oerr.SetSubjectf("'%s' in %s line %d", name, pos.rawText,
+					linenum)
+				return oerr
+			}
+		}
+		if pos.processorName == "" || len(pos.args) == 0 {
+			continue
+		}
+		// processors that don't exist are only warned about while reading.
+		pi, procvarIndex, perr := doc.findProcessorVariable(pos)
+		if perr != nil {
+			continue
+		}
+		procvar := doc.compiler.processorInfos[pi].Variables[procvarIndex]
+		if _, aerr := parseInputArguments(pos, procvar); aerr != nil {
+			aerr.SetSubjectf("%s line %d", aerr.Subject, linenum)
+			return aerr
+		}
+	}
+}
+
+// checkedFile is what checkVariables found in a document that had nothing
+// wrong with it. The document isn't looked at again until it changes.
+type checkedFile struct {
+	modTime     time.Time
+	size        int64
+	delims      Delimiters
+	max         int
+	inlinePaths []string
+}
+
+// returns the inline includes found in the document with the inode if it
+// was checked before and hasn't changed since.
+func (c *Compiler) checkedBefore(inode uint64, now checkedFile) ([]string, bool) {
+	c.checkedMu.Lock()
+	defer c.checkedMu.Unlock()
+	prev, ok := c.checked[inode]
+	if !ok || !prev.modTime.Equal(now.modTime) || prev.size != now.size ||
+		prev.delims != now.delims || prev.max != now.max {
+		return nil, false
+	}
+	return prev.inlinePaths, true
+}
+
+// remembers that the document with the inode had nothing wrong with it.
+func (c *Compiler) setChecked(inode uint64, checked checkedFile) {
+	c.checkedMu.Lock()
+	if c.checked == nil {
+		c.checked = make(map[uint64]checkedFile)
+	}
+	c.checked[inode] = checked
+	c.checkedMu.Unlock()
+}
+
+// forgets every document that was checked. The processors' variables
+// (and so what arguments they take) may have changed.
+func (c *Compiler) resetChecked() {
+	c.checkedMu.Lock()
+	c.checked = nil
+	c.checkedMu.Unlock()
+}
+
+// adds path to doc.inlinePaths if it isn't already in it.
+func (doc *Document) addInlinePath(path string) {
+	for _, p := range doc.inlinePaths {
+		if p == path {
+			return
+		}
+	}
+	doc.inlinePaths = append(doc.inlinePaths, path)
+}
+
+// returns true if the byte at is inside of a #raw.
+func (doc *Document) isVerbatim(at int64) bool {
+	for raw, end := range doc.verbatim {
+		if at >= int64(raw.charPos) && at < int64(end.charPos) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package vorlage
+
+import (
+	"bytes"
+	vorlageproc "ellem.so/vorlageproc"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEscapers(t *testing.T) {
+	tests := []struct {
+		filter string
+		input  string
+		output string
+	}{
+		{"html", `<a href="x">Tom & 'Jerry'</a>`,
+			"&lt;a href=&#34;x&#34;&gt;Tom &amp; &#39;Jerry&#39;&lt;/a&gt;"},
+		{"html", "héllo ✓", "héllo ✓"},
+		{"js", "it's \"a\"\\\n\t\r", `it\'s \"a\"\\\n\t\r`},
+		{"js", "</script> a=`b`&",
+			"\\u003C/script\\u003E a\\u003D\\u0060b\\u0060\\u0026"},
+		{"js", "\x00\x1f\u2028\u2029é", `\u0000\u001F\u2028\u2029é`},
+		{"json", "\"a\"\\\n\t\r", `\"a\"\\\n\t\r`},
+		{"json", "<b>&'\u2028", `\u003cb\u003e\u0026'\u2028`},
+		{"json", "\x01é\xff", `\u0001é\ufffd`},
+		{"url", "a b&c=d/é", "a+b%26c%3Dd%2F%C3%A9"},
+		{"upper", "héllo\xff", "HÉLLO\xff"},
+		{"lower", "HÉLLO", "héllo"},
+		{"raw", "<a>\xff", "<a>\xff"},
+	}
+	for _, test := range tests {
+		filter, ok := findFilter(test.filter)
+		if !ok {
+			t.Errorf("%s: filter isn't registered", test.filter)
+			continue
+		}
+		var out bytes.Buffer
+		w := filter(&out)
+		io.WriteString(w, test.input)
+		w.Close()
+		if out.String() != test.output {
+			t.Errorf("%s %q: got %q, expected %q", test.filter, test.input,
+				out.String(), test.output)
+		}
+	}
+}
+
+func TestRuneWriter(t *testing.T) {
+	// a character that's split between writes is only escaped once it's
+	// complete.
+	var out bytes.Buffer
+	w := RuneFilter(toUpper)(&out)
+	e := []byte("é")
+	w.Write([]byte{'a', e[0]})
+	if out.String() != "A" {
+		t.Errorf("got %q before the character was finished", out.String())
+	}
+	w.Write([]byte{e[1], 'b'})
+	w.Close()
+	if out.String() != "AÉB" {
+		t.Errorf("got %q, expected %q", out.String(), "AÉB")
+	}
+
+	// the start of a character that never finishes is flushed at Close, a
+	// byte at a time.
+	out.Reset()
+	w = RuneFilter(escapeJSON)(&out)
+	w.Write([]byte{'a', 0xe2, 0x9c})
+	if out.String() != "a" {
+		t.Errorf("got %q before Close", out.String())
+	}
+	w.Close()
+	if out.String() != `a\ufffd\ufffd` {
+		t.Errorf("got %q, expected %q", out.String(), `a\ufffd\ufffd`)
+	}
+}
+
+func TestFilteredDefinition(t *testing.T) {
+	tests := []struct {
+		filters []string
+		value   string
+		output  string
+		fails   bool
+	}{
+		{filters: []string{"upper"}, value: "<b>", output: "<B>"},
+		{filters: []string{"upper", "html"}, value: "<b>", output: "&lt;B&gt;"},
+		{filters: []string{"html", "url"}, value: "<b>",
+			output: "%26lt%3Bb%26gt%3B"},
+		{filters: []string{"html", "nope"}, fails: true},
+		// longer than what's read from the definition at a time.
+		{filters: []string{"html"}, value: strings.Repeat("é<", filterReadLength),
+			output: strings.Repeat("é&lt;", filterReadLength)},
+	}
+	for _, test := range tests {
+		def := &NormalDefinition{value: test.value}
+		f, err := newFilteredDefinition(def, test.filters)
+		if test.fails {
+			if err == nil || err.ErrStr != errUnknownFilter {
+				t.Errorf("%v: expected %q, got %v", test.filters,
+					errUnknownFilter, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.filters, err)
+			continue
+		}
+		// read it twice to make sure Reset starts it over.
+		for i := 0; i < 2; i++ {
+			out, rerr := ioutil.ReadAll(f)
+			if rerr != nil {
+				t.Errorf("%v: %s", test.filters, rerr)
+			} else if string(out) != test.output {
+				t.Errorf("%v: read %d got %q, expected %q", test.filters,
+					i, out, test.output)
+			}
+			if rerr = f.Reset(); rerr != nil {
+				t.Errorf("%v: %s", test.filters, rerr)
+			}
+		}
+	}
+}
+
+func TestRegisterFilter(t *testing.T) {
+	if err := RegisterFilter("no-dashes", rawFilter); err == nil {
+		t.Errorf("registered a filter with an invalid name")
+	}
+	if err := RegisterFilter("testreverse", RuneFilter(
+		func(r rune, raw []byte) string { return "[" + string(raw) + "]" },
+	)); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCompiler()
+	out, err := compileFiles(t, c, map[string]string{
+		"doc.html": "#define $(A) ab\n$(A:testreverse:upper)\n",
+	}, "doc.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "[A][B]\n" {
+		t.Errorf("got %q, expected %q", out, "[A][B]\n")
+	}
+}
+
+func TestCheckVariables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vorlage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "doc.html")
+	write := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	compile := func(c *Compiler) (string, error) {
+		doc, status := c.Compile(path, map[string]string{}, nil, &testActions{})
+		if status.Err != nil {
+			return "", status.Err
+		}
+		defer doc.Close()
+		out, err := ioutil.ReadAll(doc)
+		return string(out), err
+	}
+
+	c := newTestCompiler()
+	write("inc.html", "inc")
+	write("doc.html", "#define $(A) a\n$(A:html) $(#include inc.html)\n")
+	for i := 0; i < 2; i++ {
+		// the second time around the document was already checked, its
+		// inline includes must still be found.
+		out, err := compile(c)
+		if err != nil {
+			t.Fatalf("compile %d: %s", i, err)
+		}
+		if out != "a inc\n" {
+			t.Errorf("compile %d: got %q, expected %q", i, out, "a inc\n")
+		}
+	}
+
+	// changing the document has it checked again.
+	write("doc.html", "#define $(A) a\n$(A:nope) $(#include inc.html)\n")
+	if _, err = compile(c); err == nil ||
+		!strings.Contains(err.Error(), errUnknownFilter) {
+		t.Errorf("expected %q after the document changed, got %v",
+			errUnknownFilter, err)
+	}
+
+	// variables inside of #raw are not checked.
+	write("doc.html", "#raw\n$(A:nope)\n#endraw\n")
+	out, err := compile(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "$(A:nope)\n" {
+		t.Errorf("got %q, expected %q", out, "$(A:nope)\n")
+	}
+}
+
+func TestAutoEscape(t *testing.T) {
+	proc := &testProcessor{
+		info: vorlageproc.ProcessorInfo{
+			Name: "p",
+			Variables: []vorlageproc.ProcessorVariable{
+				{Name: "Html"},
+				{Name: "Raw"},
+			},
+		},
+		defines: map[string]func(vorlageproc.DefineInfo) vorlageproc.Definition{
+			"Html": func(vorlageproc.DefineInfo) vorlageproc.Definition {
+				return &NormalDefinition{value: `<b>"x"</b>`}
+			},
+			"Raw": func(vorlageproc.DefineInfo) vorlageproc.Definition {
+				return &NormalDefinition{value: "<b>", raw: true}
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		path       string
+		doc        string
+		autoEscape map[string]string
+		output     string
+	}{
+		{name: "html", path: "doc.html", doc: "$(p.Html)",
+			autoEscape: DefaultAutoEscape,
+			output:     "&lt;b&gt;&#34;x&#34;&lt;/b&gt;"},
+		{name: "longest ending wins", path: "doc.proc.json", doc: "$(p.Html)",
+			autoEscape: map[string]string{".json": "upper", ".proc.json": "json"},
+			output:     `\u003cb\u003e\"x\"\u003c/b\u003e`},
+		{name: "no matching ending", path: "doc.txt", doc: "$(p.Html)",
+			autoEscape: DefaultAutoEscape, output: `<b>"x"</b>`},
+		{name: "raw definition", path: "doc.html", doc: "$(p.Raw)",
+			autoEscape: DefaultAutoEscape, output: "<b>"},
+		{name: "raw filter", path: "doc.html", doc: "$(p.Html:raw)",
+			autoEscape: DefaultAutoEscape, output: `<b>"x"</b>`},
+		{name: "other filters", path: "doc.html", doc: "$(p.Html:upper)",
+			autoEscape: DefaultAutoEscape, output: `<B>"X"</B>`},
+		{name: "disabled", path: "doc.html", doc: "$(p.Html)",
+			output: `<b>"x"</b>`},
+		{name: "own definitions", path: "doc.html",
+			doc:        "#define $(A) <i>\n$(A)",
+			autoEscape: DefaultAutoEscape, output: "<i>"},
+	}
+	for _, test := range tests {
+		c := newTestCompiler(proc)
+		c.AutoEscape = test.autoEscape
+		out, err := compileFiles(t, c, map[string]string{test.path: test.doc},
+			test.path, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
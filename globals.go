@@ -0,0 +1,183 @@
+package vorlage
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// globalDefinitions are the definitions made by Compiler.Globals and
+// Compiler.GlobalsFile. They're loaded again whenever GlobalsFile changes.
+type globalDefinitions struct {
+	defs    []NormalDefinition
+	path    string
+	modTime time.Time
+	loaded  bool
+}
+
+// returns the global definitions every request starts off with, loading
+// them (again) if this is the first request or Compiler.GlobalsFile has
+// changed since. If they fail to load again, the ones that were loaded last
+// are kept (and a warning is logged) so a bad edit doesn't take the site
+// down.
+func (c *Compiler) currentGlobals() ([]NormalDefinition, *Error) {
+	c.globalsMu.Lock()
+	defer c.globalsMu.Unlock()
+
+	g := &c.globals
+	var modTime time.Time
+	if c.GlobalsFile != "" {
+		stat, err := os.Stat(c.GlobalsFile)
+		if err != nil {
+			oerr := NewError("failed to stat globals file")
+			oerr.SetSubject(c.GlobalsFile)
+			oerr.SetBecause(NewError(err.Error()))
+			return g.keep(oerr)
+		}
+		modTime = stat.ModTime()
+	}
+	if g.loaded && g.path == c.GlobalsFile && g.modTime.Equal(modTime) {
+		return g.defs, nil
+	}
+
+	Logger.Debugf("loading global definitions (%s)", c.GlobalsFile)
+	defs, oerr := c.loadGlobals()
+	if oerr != nil {
+		// don't try again until the file changes again.
+		g.path = c.GlobalsFile
+		g.modTime = modTime
+		return g.keep(oerr)
+	}
+	*g = globalDefinitions{
+		defs:    defs,
+		path:    c.GlobalsFile,
+		modTime: modTime,
+		loaded:  true,
+	}
+	return defs, nil
+}
+
+// helper-function for currentGlobals
+// returns the definitions that were loaded last in place of oerr. oerr is
+// only returned if they were never loaded.
+func (g *globalDefinitions) keep(oerr *Error) ([]NormalDefinition, *Error) {
+	if !g.loaded {
+		return nil, oerr
+	}
+	Logger.Warnf("keeping the global definitions that were loaded last: %s",
+		oerr)
+	return g.defs, nil
+}
+
+// helper-function for currentGlobals
+// parses Compiler.Globals and Compiler.GlobalsFile.
+func (c *Compiler) loadGlobals() ([]NormalDefinition, *Error) {
+	defs := []NormalDefinition{}
+	for name, value := range c.Globals {
+		def, oerr := createNormalDefinition(VariablePrefix+name+VariableSuffix,
+			value)
+		if oerr == nil {
+			def.kind = kindDefine
+			def.depth = globalsDepth
+			def.delims = DefaultDelimiters
+			def.source = "Compiler.Globals"
+			oerr = addDefinition(&defs, def)
+		}
+		if oerr != nil {
+			gerr := NewError("cannot parse global definition")
+			gerr.SetSubject(name)
+			gerr.SetBecause(oerr)
+			return nil, gerr
+		}
+	}
+	if c.GlobalsFile != "" {
+		oerr := c.loadGlobalsFile(&defs)
+		if oerr != nil {
+			return nil, oerr
+		}
+	}
+	return defs, nil
+}
+
+// helper-function for currentGlobals
+// adds the #define's and #macro's of Compiler.GlobalsFile to defs. Other than
+// blank lines, the file can only have those macros in it.
+func (c *Compiler) loadGlobalsFile(defs *[]NormalDefinition) (oerr *Error) {
+	path := c.GlobalsFile
+	file, err := os.Open(path)
+	if err != nil {
+		oerr = NewError("failed to open globals file")
+		oerr.SetSubject(path)
+		oerr.SetBecause(NewError(err.Error()))
+		return oerr
+	}
+	defer file.Close()
+
+	// a document that's only used to scan the macros in the file.
+	doc := &Document{
+		rawFile:         file,
+		path:            path,
+		compiler:        c,
+		delimiters:      c.delimitersFor(path),
+		MacroReadBuffer: make([]byte, MacroMaxLength),
+	}
+	var at int64
+	var linenum uint = 1
+	for {
+		n, err := file.ReadAt(doc.MacroReadBuffer, at)
+		if err != nil && err != io.EOF {
+			oerr = &Error{}
+			oerr.ErrStr = errFailedToReadBytes
+			oerr.SetSubject(path)
+			oerr.SetBecause(NewError(err.Error()))
+			return oerr
+		}
+		if n == 0 {
+			return nil
+		}
+		if bytesAreString(doc.MacroReadBuffer[:n], EndOfLine, 0) {
+			at += int64(len(EndOfLine))
+			linenum++
+			continue
+		}
+
+		pos, lines, serr := doc.scanMacro(doc.MacroReadBuffer[:n], at, linenum)
+		if serr == nil && pos.length == 0 {
+			serr = NewError("globals file can only have #define and #macro in it")
+			serr.SetSubjectf("line %d", linenum)
+		}
+		if serr != nil {
+			oerr = NewError("cannot parse globals file")
+			oerr.SetSubject(path)
+			oerr.SetBecause(serr)
+			return oerr
+		}
+
+		var def NormalDefinition
+		switch {
+		case pos.args[0] == MacroStr && len(pos.args) >= 3:
+			def, serr = createMacroDefinition(&pos, doc.delimiters)
+		case pos.args[0] == DefineStr && len(pos.args) >= 3:
+			def, serr = createNormalDefinition(
+				doc.delimiters.canonical(pos.args[1]), pos.value(2))
+		default:
+			serr = NewError("globals file can only have #define and #macro in it")
+			serr.SetSubject(pos.ToString())
+		}
+		if serr == nil {
+			def.delims = doc.delimiters
+			def.kind = kindDefine
+			def.depth = globalsDepth
+			def.source = path + " " + pos.ToString()
+			serr = addDefinition(defs, def)
+		}
+		if serr != nil {
+			oerr = NewError("cannot parse globals file")
+			oerr.SetSubjectf("%s %s", path, pos.ToString())
+			oerr.SetBecause(serr)
+			return oerr
+		}
+		at += int64(pos.length)
+		linenum += 1 + lines
+	}
+}
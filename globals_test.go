@@ -0,0 +1,138 @@
+package vorlage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vorlage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	globals := filepath.Join(dir, "globals")
+	page := filepath.Join(dir, "page.html")
+	err = ioutil.WriteFile(page, []byte("#define $(Page) page\n"+
+		"$(Site) $(Cdn) $(Page) $(Card \"x\")\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each version of the file is given its own modification time, one
+	// second apart.
+	modTime := time.Now().Add(-time.Hour)
+	writeGlobals := func(content string) {
+		if err := ioutil.WriteFile(globals, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(globals, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compile := func(c *Compiler) (string, error) {
+		doc, status := c.Compile(page, map[string]string{}, nil, &testActions{})
+		if status.Err != nil {
+			return "", status.Err
+		}
+		defer doc.Close()
+		out, err := ioutil.ReadAll(doc)
+		return string(out), err
+	}
+	expect := func(c *Compiler, step, output string) {
+		out, err := compile(c)
+		if err != nil {
+			t.Errorf("%s: %s", step, err)
+		} else if out != output {
+			t.Errorf("%s: got %q, expected %q", step, out, output)
+		}
+	}
+
+	c := newTestCompiler()
+	c.Globals = map[string]string{"Cdn": "cdn", "Page": "global"}
+	c.GlobalsFile = globals
+
+	// the file has to load the first time.
+	if _, err = compile(c); err == nil ||
+		!strings.Contains(err.Error(), "failed to stat globals file") {
+		t.Errorf("expected the missing file to fail, got %v", err)
+	}
+
+	writeGlobals("#define $(Site) site\n\n#macro $(Card a) [$(a)]\n")
+	expect(c, "first", "site cdn page [x]\n")
+
+	writeGlobals("#define $(Site) changed\n#macro $(Card a) ($(a))\n")
+	expect(c, "modified", "changed cdn page (x)\n")
+
+	// a mistake keeps the definitions that were loaded last.
+	writeGlobals("#define $(Site) broken\n#include nav.html\n")
+	expect(c, "mistake", "changed cdn page (x)\n")
+	os.Remove(globals)
+	expect(c, "removed", "changed cdn page (x)\n")
+
+	writeGlobals("#define $(Site) fixed\n")
+	expect(c, "fixed", "fixed cdn page $(Card \"x\")\n")
+}
+
+func TestGlobalsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		globals string
+		defs    int
+		fails   string // the error it fails with
+	}{
+		{name: "defines and macros",
+			globals: "#define $(A) a\n\n#macro $(B x) $(x)\n", defs: 2},
+		{name: "empty", globals: "\n\n"},
+		{name: "text",
+			globals: "#define $(A) a\ntext\n",
+			fails:   "globals file can only have #define and #macro in it"},
+		{name: "other macros",
+			globals: "#default $(A) a\n",
+			fails:   "globals file can only have #define and #macro in it"},
+		{name: "includes",
+			globals: "#include nav.html\n",
+			fails:   "globals file can only have #define and #macro in it"},
+		{name: "defined twice",
+			globals: "#define $(A) a\n#define $(A) b\n",
+			fails:   "cannot parse globals file"},
+		{name: "invalid macro",
+			globals: "#macro $(B x,) $(x)\n",
+			fails:   "#macro parameter has an invalid name"},
+	}
+	file, err := ioutil.TempFile("", "vorlage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	for _, test := range tests {
+		err := ioutil.WriteFile(file.Name(), []byte(test.globals), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := newTestCompiler()
+		c.GlobalsFile = file.Name()
+		defs := []NormalDefinition{}
+		oerr := c.loadGlobalsFile(&defs)
+		if test.fails != "" {
+			if oerr == nil || !strings.Contains(oerr.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.fails, oerr)
+			}
+			continue
+		}
+		if oerr != nil {
+			t.Errorf("%s: %s", test.name, oerr)
+			continue
+		}
+		if len(defs) != test.defs {
+			t.Errorf("%s: got %d definitions, expected %d", test.name,
+				len(defs), test.defs)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 	"vorlage"
@@ -23,6 +24,13 @@ var ConfigFile = "/etc/vorlage/http.conf"
 var TLSPrivateKey = ""
 var TLSPublicKey = ""
 var reloadProcessors = true
+var contentMacros = false
+var autoEscape = false
+var delimiters []string
+var includePath []string
+var rootIncludes = false
+var globalsFile = ""
+var maxVariableLength = vorlage.DefaultMaxVariableLength
 
 var config = []ConfigBinding{
 	{
@@ -77,6 +85,41 @@ If http-usefcgi is enabled, this is ignored.`,
 		Description: "If true, then vorlage will automatically re-load processors if it detects the file has changed. Use only for debugging and developing.",
 		VarAddress:  &reloadProcessors,
 	},
+	{
+		Name:        "vorlage-content-macros",
+		Description: "If true, macros such as #define, #include, and #if will also be recognised when they're found after the top of a document. Macros that are only of use in the content (#include, #if, #foreach, #block, and #raw) need this.",
+		VarAddress:  &contentMacros,
+	},
+	{
+		Name:        "vorlage-auto-escape",
+		Description: "If true, processor variables that aren't given any filters are escaped depending on the requested document's file name (ie, with the html filter in .html documents).",
+		VarAddress:  &autoEscape,
+	},
+	{
+		Name:        "vorlage-delimiters",
+		Description: "A list of file endings followed by the prefix and suffix that variables in those files are written with instead of $( and ). For example, '.js {{ }}'.",
+		VarAddress:  &delimiters,
+	},
+	{
+		Name:        "vorlage-root-includes",
+		Description: "If true, included documents whose path starts with a / are relative to http-documentroot instead of the document including them, and documents outside of http-documentroot and vorlage-include-path can't be included.",
+		VarAddress:  &rootIncludes,
+	},
+	{
+		Name:        "vorlage-include-path",
+		Description: "Directories that are looked in (in order) for included documents that aren't found relative to the document including them. See vorlage-root-includes.",
+		VarAddress:  &includePath,
+	},
+	{
+		Name:        "vorlage-globals",
+		Description: "A path to a file of #define's that will be defined in every document. The file is loaded again when it changes. Leave blank to disable.",
+		VarAddress:  &globalsFile,
+	},
+	{
+		Name:        "vorlage-max-variable-length",
+		Description: "The longest a variable can be (including its prefix and suffix). Anything longer that looks like a variable is outputted as it was written.",
+		VarAddress:  &maxVariableLength,
+	},
 	{
 		Name:        "log-debug",
 		Description: "If set, will output debug information to the file. Note that outputting debug information must only be done when, well, debugging. Enabling debugging may cause dramatic slow downs.",
@@ -237,6 +280,27 @@ Full license at https://www.ellem.ai/vorlage/license.html
 		os.Exit(1)
 		return
 	}
+	c.ContentMacros = contentMacros
+	if autoEscape {
+		c.AutoEscape = vorlage.DefaultAutoEscape
+	}
+	c.GlobalsFile = globalsFile
+	if rootIncludes {
+		c.DocumentRoot = DocumentRoot
+	}
+	c.IncludePath = includePath
+	c.MaxVariableLength = maxVariableLength
+	c.Delimiters, err = parseDelimiters(delimiters)
+	if err != nil {
+		errmsg := fmt.Sprintf("failed to parse vorlage-delimiters: %s", err)
+		mainlogContext.Errorf(errmsg)
+		err2 := sdError(syscall.EINVAL, errmsg)
+		if err2 != nil {
+			mainlogContext.Noticef("failed to update systemd status: %s", err2.Error())
+		}
+		os.Exit(1)
+		return
+	}
 
 	// Load the TLS files if present
 	// This step is largely redundant. As the LoadX509KeyPair will be called
@@ -359,3 +423,20 @@ Full license at https://www.ellem.ai/vorlage/license.html
 	}
 	return
 }
+
+// parses the entries of vorlage-delimiters, each being a file ending, a
+// prefix, and a suffix separated by spaces (ie ".js {{ }}").
+func parseDelimiters(entries []string) (map[string]vorlage.Delimiters, error) {
+	ret := make(map[string]vorlage.Delimiters, len(entries))
+	for _, e := range entries {
+		fields := strings.Fields(e)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("'%s' must be an ending, a prefix, and a suffix", e)
+		}
+		ret[fields[0]] = vorlage.Delimiters{Prefix: fields[1], Suffix: fields[2]}
+	}
+	return ret, nil
+}
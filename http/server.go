@@ -28,6 +28,10 @@ type handler struct {
 type actionhandler struct {
 	writer  http.ResponseWriter
 	request *http.Request
+
+	// the status code that will be written before the compiled document,
+	// 0 if it wasn't set.
+	status *int
 }
 
 func (a actionhandler) ActionCritical(err error) {
@@ -40,10 +44,19 @@ func (a actionhandler) ActionAccessFail(err error) {
 	_, _ = a.writer.Write([]byte(err.Error()))
 }
 
+func (a actionhandler) ActionBadRequest(err error) {
+	a.writer.WriteHeader(http.StatusBadRequest)
+	_, _ = a.writer.Write([]byte(err.Error()))
+}
+
 func (a actionhandler) ActionSee(path string) {
 	http.Redirect(a.writer, a.request, path, http.StatusSeeOther)
 }
 
+func (a actionhandler) ActionRedirect(path string, code int) {
+	http.Redirect(a.writer, a.request, path, code)
+}
+
 func (a actionhandler) ActionHTTPHeader(header string) {
 	parts := strings.SplitN(header, ":", 2)
 	if len(parts) != 2 {
@@ -53,6 +66,12 @@ func (a actionhandler) ActionHTTPHeader(header string) {
 	a.writer.Header().Add(parts[0], parts[1])
 }
 
+func (a actionhandler) ActionStatus(code int) {
+	// the status can only be written once the headers are done, which is
+	// right before the document is.
+	*a.status = code
+}
+
 func auth() {
 
 }
@@ -73,7 +92,7 @@ func (h handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 
 	// transversal attacks
 	if BlockTransversalAttack {
-		if isUpwardTransversal(request.URL.Path) {
+		if vorlage.IsUpwardTransversal(request.URL.Path) {
 			httplogContext.Warnf("%s - is upward transversal", request.URL.Path)
 			writer.WriteHeader(http.StatusBadRequest)
 			return
@@ -161,6 +180,7 @@ func (h handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	var streaminputs map[string]vorlageproc.StreamInput
 	var cookies []*http.Cookie
 	var cstat vorlage.CompileStatus
+	var actions = actionhandler{writer, request, new(int)}
 	defer func() {
 		if stream != nil {
 			stream.Close()
@@ -283,7 +303,7 @@ func (h handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	// compile the document and get an Rid
-	stream, cstat = h.compiler.Compile(fileToUse, inputs, streaminputs, actionhandler{writer, request})
+	stream, cstat = h.compiler.Compile(fileToUse, inputs, streaminputs, actions)
 	if cstat.Err != nil {
 		if cstat.WasProcessor {
 			// don't do anything because actionhandler's interface was called
@@ -320,6 +340,9 @@ writeStream:
 			writer.Header().Add("Content-Type", "application/octet-stream")
 		}
 	}
+	if *actions.status != 0 {
+		writer.WriteHeader(*actions.status)
+	}
 	buff := make([]byte, ProcessingBufferSize)
 	_, err = io.CopyBuffer(writer, stream, buff)
 	if err != nil {
@@ -352,45 +375,6 @@ func (f fupload) GetLen() (n uint64, err error) {
 
 var _ vorlageproc.StreamInput = fupload{}
 
-/*
- * Returns true if path will upward transversal (aka transversal attack).
- * Returns false if the path does not contain a upward transversal.
- *
- * For example, these will contain an upward transversal:
- *     "/.."
- *     "/www/../.."
- *     "/../etc/passwd"
- *     "/www/../../etc/passwd"
- *     "/../../../../../../../../etc/passwd"
- *
- * And these would NOT contain upward transversal:
- *     "/"
- *     "/www/../www2"
- *     "/www/../www2/file"
- *
- */
-func isUpwardTransversal(path string) bool {
-	parts := strings.Split(path, string(os.PathSeparator))
-	var transversal int
-	for _, p := range parts {
-		if p == ".." {
-			// they went up a directory
-			transversal--
-		} else if p == "." || p == "" {
-			// they stayed in the same directory (no transversal)
-		} else {
-			// they went down a directory
-			transversal++
-		}
-		// if they're negative, that means they went above more directories than
-		// they did go down.
-		if transversal < 0 {
-			return true
-		}
-	}
-	return false
-}
-
 /*
  * Serve accepts incoming HTTP connections on listener l using
  * net/http to handle all the http protocols and vorlageproc to handle the
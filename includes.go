@@ -0,0 +1,310 @@
+package vorlage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// the arguments that can follow the pattern of a #prepend or #append (ie
+// "#append news/*.html order=mtime reverse").
+const IncludeOrder = "order="
+const IncludeOrderName = "name"
+const IncludeOrderMtime = "mtime"
+const IncludeReverse = "reverse"
+
+// the characters that make the path of a #prepend or #append a pattern
+// (see filepath.Match), unless the path is in quotes.
+const includePatternChars = "*?["
+
+// helper-function for Document.include
+// finds the file path refers to when doc includes it. Paths starting with
+// a "/" are relative to Compiler.DocumentRoot (if it's set), every other
+// path is looked for relative to doc and then in each directory of
+// Compiler.IncludePath.
+func (doc *Document) resolveInclude(path string) (resolved string,
+	stat syscall.Stat_t, oerr *Error) {
+	candidates := doc.includeCandidates(path)
+	var firstErr error
+	for _, candidate := range candidates {
+		cerr := syscall.Stat(candidate.path, &stat)
+		if cerr != nil {
+			if firstErr == nil {
+				firstErr = cerr
+			}
+			continue
+		}
+		if !doc.compiler.withinRoots(candidate.path, candidate.includeDir) {
+			oerr = NewError(errOutsideRoots)
+			oerr.SetSubject(candidate.path)
+			return candidate.path, stat, oerr
+		}
+		return candidate.path, stat, nil
+	}
+	oerr = NewError("failed to stat document")
+	oerr.SetSubject(candidates[0].path)
+	oerr.SetBecause(NewError(firstErr.Error()))
+	return candidates[0].path, stat, oerr
+}
+
+// includeCandidate is a path that an include could be referring to.
+type includeCandidate struct {
+	path string
+
+	// the directory of Compiler.IncludePath that path is in, "" if it isn't
+	// from the IncludePath.
+	includeDir string
+}
+
+// returns the paths that path could be referring to when doc includes it,
+// in the order they're looked at (see resolveInclude).
+func (doc *Document) includeCandidates(path string) []includeCandidate {
+	if strings.HasPrefix(path, string(filepath.Separator)) &&
+		doc.compiler.DocumentRoot != "" {
+		return []includeCandidate{
+			{path: filepath.Join(doc.compiler.DocumentRoot, path)},
+		}
+	}
+	candidates := []includeCandidate{
+		{path: filepath.Dir(doc.path) + string(filepath.Separator) + path},
+	}
+	for _, dir := range doc.compiler.IncludePath {
+		candidates = append(candidates, includeCandidate{
+			path:       filepath.Join(dir, path),
+			includeDir: dir,
+		})
+	}
+	return candidates
+}
+
+// returns true if path is inside of Compiler.DocumentRoot or one of the
+// directories of Compiler.IncludePath. If DocumentRoot isn't set, every path
+// is, unless it was found in includeDir (a directory of IncludePath) in
+// which case it must be inside of it. Symbolic links are followed, so a
+// link inside of the document root to somewhere outside of it is outside.
+func (c *Compiler) withinRoots(path string, includeDir string) bool {
+	roots := append([]string{c.DocumentRoot}, c.IncludePath...)
+	if c.DocumentRoot == "" {
+		if includeDir == "" {
+			return true
+		}
+		roots = []string{includeDir}
+	}
+	resolved, err := realPath(path)
+	if err != nil {
+		return false
+	}
+	for _, root := range roots {
+		realRoot, err := realPath(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(realRoot, resolved)
+		if err == nil && !IsUpwardTransversal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper-function for withinRoots
+// returns the absolute path of path with its symbolic links followed.
+func realPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+/*
+ * Returns true if path will upward transversal (aka transversal attack).
+ * Returns false if the path does not contain a upward transversal.
+ *
+ * For example, these will contain an upward transversal:
+ *     "/.."
+ *     "/www/../.."
+ *     "/../etc/passwd"
+ *     "/www/../../etc/passwd"
+ *     "/../../../../../../../../etc/passwd"
+ *
+ * And these would NOT contain upward transversal:
+ *     "/"
+ *     "/www/../www2"
+ *     "/www/../www2/file"
+ *
+ */
+func IsUpwardTransversal(path string) bool {
+	parts := strings.Split(path, string(os.PathSeparator))
+	var transversal int
+	for _, p := range parts {
+		if p == ".." {
+			// they went up a directory
+			transversal--
+		} else if p == "." || p == "" {
+			// they stayed in the same directory (no transversal)
+		} else {
+			// they went down a directory
+			transversal++
+		}
+		// if they're negative, that means they went above more directories than
+		// they did go down.
+		if transversal < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// helper-function for loadDocumentFromPath
+// includes the documents of the #prepend or #append at m. If its path is a
+// pattern (ie "news/*.html") every document that matches it is included,
+// sorted by name unless it was given other orders.
+func (doc *Document) includeAll(m *macoPos) ([]*Document, *Error) {
+	path := strings.Join(m.args[1:], string(MacroArgument))
+	if m.quoted(1) || !strings.ContainsAny(path, includePatternChars) {
+		inc, oerr := doc.include(path)
+		if oerr != nil {
+			return nil, oerr
+		}
+		return []*Document{inc}, nil
+	}
+
+	// the order arguments are at the end.
+	order := IncludeOrderName
+	var reverse bool
+	args := m.args[1:]
+	for len(args) > 1 {
+		last := args[len(args)-1]
+		if last == IncludeReverse {
+			reverse = true
+		} else if strings.HasPrefix(last, IncludeOrder) {
+			order = last[len(IncludeOrder):]
+			if order != IncludeOrderName && order != IncludeOrderMtime {
+				oerr := NewError("unknown order")
+				oerr.SetSubjectf("'%s' %s", order, m.ToString())
+				return nil, oerr
+			}
+		} else {
+			break
+		}
+		args = args[:len(args)-1]
+	}
+	pattern := strings.Join(args, string(MacroArgument))
+
+	matches, oerr := doc.globInclude(pattern)
+	if oerr != nil {
+		oerr.SetSubjectf("%s %s", oerr.Subject, m.ToString())
+		return nil, oerr
+	}
+	oerr = sortIncludes(matches, order, reverse)
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	if len(matches) == 0 {
+		Logger.Warnf("'%s' didn't match any documents (%s %s)", pattern,
+			doc.path, m.ToString())
+	}
+	Logger.Debugf("'%s' matched %d documents in %s", pattern, len(matches),
+		doc.path)
+	incs := make([]*Document, 0, len(matches))
+	for _, match := range matches {
+		var stat syscall.Stat_t
+		if cerr := syscall.Stat(match, &stat); cerr != nil {
+			oerr := NewError("failed to stat document")
+			oerr.SetSubject(match)
+			oerr.SetBecause(NewError(cerr.Error()))
+			return nil, oerr
+		}
+		if stat.Ino == doc.fileInode {
+			// the document's pattern matched itself.
+			continue
+		}
+		inc, oerr := doc.includeResolved(match, match, stat)
+		if oerr != nil {
+			return nil, oerr
+		}
+		incs = append(incs, inc)
+	}
+	return incs, nil
+}
+
+// helper-function for includeAll
+// finds the files that match pattern the same way resolveInclude finds a
+// path: the first place that has any matches is used. The directories that
+// were looked in are added to the root's dependantDirs.
+func (doc *Document) globInclude(pattern string) ([]string, *Error) {
+	for _, candidate := range doc.includeCandidates(pattern) {
+		if dir := filepath.Dir(candidate.path); !strings.ContainsAny(dir,
+			includePatternChars) {
+			doc.addDependantDir(dir)
+		}
+		matches, err := filepath.Glob(candidate.path)
+		if err != nil {
+			oerr := NewError("invalid pattern")
+			oerr.SetSubject(pattern)
+			oerr.SetBecause(NewError(err.Error()))
+			return nil, oerr
+		}
+		var files []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			if !doc.compiler.withinRoots(match, candidate.includeDir) {
+				oerr := NewError(errOutsideRoots)
+				oerr.SetSubject(match)
+				return nil, oerr
+			}
+			doc.addDependantDir(filepath.Dir(match))
+			files = append(files, match)
+		}
+		if len(files) != 0 {
+			return files, nil
+		}
+	}
+	return nil, nil
+}
+
+// adds dir to the root's dependantDirs if it isn't already in there.
+func (doc *Document) addDependantDir(dir string) {
+	for _, d := range *doc.dependantDirs {
+		if d == dir {
+			return
+		}
+	}
+	*doc.dependantDirs = append(*doc.dependantDirs, dir)
+}
+
+// helper-function for includeAll
+// sorts the files by the order given (see IncludeOrderName and
+// IncludeOrderMtime). Files with the same modification time are sorted by
+// name so the order is always the same.
+func sortIncludes(files []string, order string, reverse bool) *Error {
+	sort.Strings(files)
+	if order == IncludeOrderMtime {
+		mtimes := make(map[string]int64, len(files))
+		for _, f := range files {
+			info, err := os.Stat(f)
+			if err != nil {
+				oerr := NewError("failed to stat document")
+				oerr.SetSubject(f)
+				oerr.SetBecause(NewError(err.Error()))
+				return oerr
+			}
+			mtimes[f] = info.ModTime().UnixNano()
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return mtimes[files[i]] < mtimes[files[j]]
+		})
+	}
+	if reverse {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package vorlage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsUpwardTransversal(t *testing.T) {
+	tests := []struct {
+		path   string
+		upward bool
+	}{
+		{"/", false},
+		{"", false},
+		{"a/b", false},
+		{"/www/../www2", false},
+		{"/www/../www2/file", false},
+		{"./a/./b/..", false},
+		{"a/..", false},
+		{"..", true},
+		{"/..", true},
+		{"a/../..", true},
+		{"/www/../../etc/passwd", true},
+		{"../a", true},
+		{"..a/b", false},
+	}
+	for _, test := range tests {
+		if IsUpwardTransversal(test.path) != test.upward {
+			t.Errorf("%q: expected %v", test.path, test.upward)
+		}
+	}
+}
+
+func TestWithinRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"root/sub", "inc", "outside", "rootfix"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"root/a.html", "root/sub/b.html",
+		"inc/c.html", "outside/d.html", "rootfix/e.html"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/out":  "../outside",
+		"root/back": "sub",
+		"rootlink":  "root",
+		"inc/out":   "../outside",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		docroot    string
+		path       string
+		includeDir string // found through this directory of IncludePath
+		within     bool
+	}{
+		{"root", "root/a.html", "", true},
+		{"root", "root/sub/b.html", "", true},
+		{"root", "root/sub/../a.html", "", true},
+		{"root", "root/../outside/d.html", "", false},
+		{"root", "inc/c.html", "", true},
+		{"root", "inc/c.html", "inc", true},
+		{"root", "outside/d.html", "", false},
+		{"root", "rootfix/e.html", "", false},
+		{"root", "root/out/d.html", "", false},
+		{"root", "root/back/b.html", "", true},
+		{"rootlink", "root/a.html", "", true},
+		{"root", "rootlink/a.html", "", true},
+		{"root", "inc/out/d.html", "inc", false},
+		{"", "outside/d.html", "", true},
+		{"", "root/out/d.html", "", true},
+		{"", "inc/c.html", "inc", true},
+		{"", "inc/../outside/d.html", "inc", false},
+		{"", "inc/out/d.html", "inc", false},
+		{"", "root/a.html", "inc", false},
+	}
+	for _, test := range tests {
+		c := &Compiler{IncludePath: []string{filepath.Join(dir, "inc")}}
+		if test.docroot != "" {
+			c.DocumentRoot = filepath.Join(dir, test.docroot)
+		}
+		includeDir := ""
+		if test.includeDir != "" {
+			includeDir = filepath.Join(dir, test.includeDir)
+		}
+		if c.withinRoots(filepath.Join(dir, test.path), includeDir) !=
+			test.within {
+			t.Errorf("%q in %q (through %q): expected %v", test.path,
+				test.docroot, test.includeDir, test.within)
+		}
+	}
+}
+
+func TestSortIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// name and how many seconds ago it was modified.
+	files := []struct {
+		name string
+		age  int
+	}{{"b", 30}, {"a", 10}, {"d", 20}, {"c", 20}}
+	now := time.Now()
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-time.Duration(f.age) * time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		order   string
+		reverse bool
+		sorted  string
+	}{
+		{IncludeOrderName, false, "abcd"},
+		{IncludeOrderName, true, "dcba"},
+		{IncludeOrderMtime, false, "bcda"},
+		{IncludeOrderMtime, true, "adcb"},
+	}
+	for _, test := range tests {
+		var paths, expected []string
+		for _, f := range files {
+			paths = append(paths, filepath.Join(dir, f.name))
+		}
+		for _, name := range test.sorted {
+			expected = append(expected, filepath.Join(dir, string(name)))
+		}
+		if oerr := sortIncludes(paths, test.order, test.reverse); oerr != nil {
+			t.Errorf("%s %v: %s", test.order, test.reverse, oerr)
+			continue
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%s %v: got %q, expected %q", test.order, test.reverse,
+				paths, expected)
+		}
+	}
+
+	missing := []string{filepath.Join(dir, "a"), filepath.Join(dir, "gone")}
+	if sortIncludes(missing, IncludeOrderMtime, false) == nil {
+		t.Errorf("expected an error for a file that doesn't exist")
+	}
+}
+
+func TestIncludeAll(t *testing.T) {
+	news := map[string]string{
+		"news/b.html": "b\n",
+		"news/a.html": "a\n",
+		"news/c.txt":  "c\n",
+	}
+	tests := []struct {
+		name   string
+		files  map[string]string
+		doc    string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "sorted by name", files: news,
+			doc:    "#prepend news/*.html\ndoc\n",
+			output: "a\nb\ndoc\n"},
+		{name: "reverse", files: news,
+			doc:    "#append news/*.html reverse\ndoc\n",
+			output: "doc\nb\na\n"},
+		{name: "order and reverse", files: news,
+			doc:    "#append news/* order=name reverse\ndoc\n",
+			output: "doc\nc\nb\na\n"},
+		{name: "brackets", files: news,
+			doc:    "#prepend news/[ab].html\ndoc\n",
+			output: "a\nb\ndoc\n"},
+		{name: "matches itself",
+			files:  map[string]string{"x.html": "x\n"},
+			doc:    "#append *.html\ndoc\n",
+			output: "doc\nx\n"},
+		{name: "matches nothing", files: news,
+			doc:    "#prepend news/*.md\ndoc\n",
+			output: "doc\n"},
+		{name: "quoted",
+			files:  map[string]string{"a*.html": "star\n", "ab.html": "ab\n"},
+			doc:    "#prepend \"a*.html\"\ndoc\n",
+			output: "star\ndoc\n"},
+		{name: "directories are skipped",
+			files:  map[string]string{"news/a.html": "a\n", "news/d.html/e": "e\n"},
+			doc:    "#prepend news/*.html\ndoc\n",
+			output: "a\ndoc\n"},
+		{name: "unknown order", files: news,
+			doc:   "#prepend news/*.html order=size\n",
+			fails: "unknown order"},
+		{name: "invalid pattern", files: news,
+			doc:   "#prepend news/[.html\n",
+			fails: "invalid pattern"},
+	}
+	for _, test := range tests {
+		files := map[string]string{"doc.html": test.doc}
+		for name, content := range test.files {
+			files[name] = content
+		}
+		out, err := compileFiles(t, newTestCompiler(), files, "doc.html", nil)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v (%q)", test.name, test.fails,
+					err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
+
+func TestGlobInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "glob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"site/news", "site/empty", "inc/news",
+		"inc/empty", "outside"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"site/doc.html", "site/news/a.html",
+		"inc/news/b.html", "inc/empty/c.html", "outside/d.html"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../../outside/d.html",
+		filepath.Join(dir, "site/news/link.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pattern string
+		docroot bool
+		matches []string
+		fails   string // the error it fails with
+	}{
+		// the first place that has any matches is used.
+		{pattern: "news/a.html", matches: []string{"site/news/a.html"}},
+		{pattern: "news/b.html", matches: []string{"inc/news/b.html"}},
+		{pattern: "empty/*.html", matches: []string{"inc/empty/c.html"}},
+		{pattern: "nope/*.html"},
+		{pattern: "news/*.html",
+			matches: []string{"site/news/a.html", "site/news/link.html"}},
+		{pattern: "news/*.html", docroot: true, fails: errOutsideRoots},
+		{pattern: "/news/a*.html", docroot: true,
+			matches: []string{"site/news/a.html"}},
+		{pattern: "../inc/*/b.html", docroot: true,
+			matches: []string{"inc/news/b.html"}},
+		{pattern: "../outside/*.html", docroot: true, fails: errOutsideRoots},
+	}
+	for _, test := range tests {
+		c := &Compiler{IncludePath: []string{filepath.Join(dir, "inc")}}
+		if test.docroot {
+			c.DocumentRoot = filepath.Join(dir, "site")
+		}
+		doc := &Document{
+			compiler:      c,
+			path:          filepath.Join(dir, "site/doc.html"),
+			dependantDirs: &[]string{},
+		}
+		matches, oerr := doc.globInclude(test.pattern)
+		if test.fails != "" {
+			if oerr == nil || oerr.ErrStr != test.fails {
+				t.Errorf("%s: expected %q, got %v", test.pattern, test.fails,
+					oerr)
+			}
+			continue
+		}
+		if oerr != nil {
+			t.Errorf("%s: %s", test.pattern, oerr)
+			continue
+		}
+		var expected []string
+		for _, m := range test.matches {
+			expected = append(expected, filepath.Join(dir, m))
+		}
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("%s: got %q, expected %q", test.pattern, matches,
+				expected)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package vorlage
+
+import (
+	"regexp"
+	"strings"
+)
+
+const InputRequired = "required"
+const InputPattern = "pattern="
+const InputDefault = "default="
+
+// documentInput is an input that a document expects to be given (#input).
+type documentInput struct {
+	pos        *macoPos
+	name       string
+	required   bool
+	pattern    *regexp.Regexp // nil if any value will do
+	value      string         // the default
+	hasDefault bool
+}
+
+// parses the arguments of an #input macro
+// (ie "#input page required pattern=[0-9]+ default=1")
+func parseInput(m *macoPos) (*documentInput, *Error) {
+	if len(m.args) < 2 {
+		oerr := NewError("#input missing arguments")
+		oerr.SetSubject(m.ToString())
+		return nil, oerr
+	}
+	input := &documentInput{pos: m, name: m.args[1]}
+	for _, arg := range m.args[2:] {
+		switch {
+		case arg == InputRequired:
+			input.required = true
+		case strings.HasPrefix(arg, InputPattern):
+			// the pattern must match the entire value.
+			p, err := regexp.Compile("^(?:" + arg[len(InputPattern):] + ")$")
+			if err != nil {
+				oerr := NewError("#input has an invalid pattern")
+				oerr.SetSubjectf("%s %s", input.name, m.ToString())
+				oerr.SetBecause(NewError(err.Error()))
+				return nil, oerr
+			}
+			input.pattern = p
+		case strings.HasPrefix(arg, InputDefault):
+			input.value = arg[len(InputDefault):]
+			input.hasDefault = true
+		default:
+			oerr := NewError("#input has an unknown argument")
+			oerr.SetSubjectf("'%s' %s", arg, m.ToString())
+			return nil, oerr
+		}
+	}
+	return input, nil
+}
+
+// gives the inputs declared by this document and every document it included
+// their default if they weren't given (or are empty).
+func (doc *Document) defaultInputs(allInput map[string]string) {
+	docs := append([]*Document{doc}, *doc.allIncluded...)
+	for _, d := range docs {
+		for _, input := range d.inputs {
+			if allInput[input.name] == "" && input.hasDefault {
+				allInput[input.name] = input.value
+			}
+		}
+	}
+}
+
+// goes through the inputs declared by this document and every document it
+// included (after defaultInputs). An error is returned if an input is
+// required but wasn't given, or if it doesn't match its pattern.
+func (doc *Document) checkInputs(allInput map[string]string) *Error {
+	docs := append([]*Document{doc}, *doc.allIncluded...)
+	for _, d := range docs {
+		for _, input := range d.inputs {
+			if input.required && allInput[input.name] == "" {
+				oerr := NewError(errMissingInput)
+				oerr.SetSubjectf("'%s' (%s %s)", input.name, d.path,
+					input.pos.ToString())
+				return oerr
+			}
+			v := allInput[input.name]
+			if input.pattern != nil && v != "" && !input.pattern.MatchString(v) {
+				oerr := NewError(errInvalidInput)
+				oerr.SetSubjectf("'%s' (%s %s)", input.name, d.path,
+					input.pos.ToString())
+				return oerr
+			}
+		}
+	}
+	return nil
+}
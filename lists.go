@@ -0,0 +1,190 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"strings"
+)
+
+// ListDefinition is a vorlageproc.Definition that is made up of a list of
+// records which can be iterated over with #foreach. Processors written in
+// Go only need to give their Definition the Len and Field methods (they
+// don't need to import this package). Processors written in C must define
+// vorlage_proc_definer_len and vorlage_proc_definer_field.
+type ListDefinition interface {
+	vorlageproc.Definition
+
+	// Len returns the amount of records in the list. -1 must be returned
+	// if the definition isn't a list.
+	Len() int
+
+	// Field returns the value of the field found in the record at index.
+	// ok must be false if the record does not have the field.
+	Field(index int, name string) (value string, ok bool)
+}
+
+// RecordList is a ListDefinition for processors that have all their records
+// in memory. When read as a normal definition, it's empty.
+type RecordList []map[string]string
+
+func (r RecordList) Read(p []byte) (int, error) {
+	return (&NormalDefinition{}).Read(p)
+}
+
+func (r RecordList) Reset() error {
+	return nil
+}
+
+func (r RecordList) Close() error {
+	return nil
+}
+
+func (r RecordList) Len() int {
+	return len(r)
+}
+
+func (r RecordList) Field(index int, name string) (string, bool) {
+	v, ok := r[index][name]
+	return v, ok
+}
+
+var _ ListDefinition = RecordList{}
+
+// foreachBlock is a parsed #foreach and the #endforeach that ends it.
+type foreachBlock struct {
+	pos      *macoPos
+	variable variablePos
+	end      *macoPos
+}
+
+// parses the arguments of a #foreach macro
+func parseForeach(m *macoPos, delims Delimiters) (*foreachBlock, *Error) {
+	variable := strings.Join(m.args[1:], string(MacroArgument))
+	pos, serr := scanVariable([]byte(variable), 0, delims)
+	if serr == nil && (int(pos.length) != len(variable) || pos.escaped) {
+		serr = NewError(errVariableName)
+		serr.SetSubjectf("'%s'", variable)
+	}
+	if serr != nil {
+		oerr := NewError("#foreach must be given a single variable")
+		oerr.SetSubject(m.ToString())
+		oerr.SetBecause(serr)
+		return nil, oerr
+	}
+	return &foreachBlock{pos: m, variable: pos}, nil
+}
+
+// listScope is a #foreach that is currently being read. The record at index
+// in list is what the variables inside of the block are defined by.
+type listScope struct {
+	loop  *foreachBlock
+	list  ListDefinition
+	index int
+}
+
+// finds the definition of the variable at pos. Fields of the records being
+// iterated over by #foreach take priority over the document's definitions
+// (see nonConvertedFile.field). nested is false if the definition must be
+// outputted verbatim (see Nested Variables in the manual).
+func (c *nonConvertedFile) define(pos variablePos) (def vorlageproc.Definition, nested bool, err error) {
+	if pos.include != "" {
+		// the document defines its own variables.
+		inc := c.sourceDocument.includedInline(pos.include)
+		if inc == nil {
+			oerr := NewError(errNotDefined)
+			oerr.SetSubject(pos.rawText)
+			return nil, false, oerr
+		}
+		inc.readBy(c)
+		if rerr := inc.Reset(); rerr != nil {
+			return nil, false, rerr
+		}
+		return inc, false, nil
+	}
+	if pos.processorName == "" {
+		if v, raw, ok := c.field(pos.variableName); ok {
+			// like processor variables, fields are not nested.
+			return &NormalDefinition{
+				variable: pos.fullName,
+				value:    v,
+				raw:      raw,
+			}, false, nil
+		}
+	}
+	def, err = c.sourceDocument.define(pos, c)
+	// arguments given to processor variables are their input, see
+	// Document.define
+	if err == nil && len(pos.args) != 0 && pos.processorName == "" {
+		if aerr := checkMacroArguments(def, pos); aerr != nil {
+			_ = def.Close()
+			return nil, false, aerr
+		}
+	}
+	return def, pos.processorName == "", err
+}
+
+// same as Document.isDefined but also looks at the fields of the records
+// being iterated over.
+func (c *nonConvertedFile) isDefined(pos variablePos) bool {
+	if pos.processorName == "" {
+		if _, _, ok := c.field(pos.variableName); ok {
+			return true
+		}
+	}
+	return c.sourceDocument.isDefined(pos, c)
+}
+
+// returns the field called name in the records being iterated over, the
+// inner-most #foreach first. The #foreach's of the files that are reading
+// this one (see nonConvertedFile.includer) are looked at as well, so a
+// document that's #include'd inside of a block can use the fields. raw is
+// true if the list is a RawDefinition that is to be left alone.
+func (c *nonConvertedFile) field(name string) (value string, raw bool,
+	ok bool) {
+	for f := c; f != nil; f = f.includer {
+		for i := len(f.scopes) - 1; i >= 0; i-- {
+			s := f.scopes[i]
+			if value, ok = s.list.Field(s.index, name); ok {
+				r, _ := s.list.(RawDefinition)
+				return value, r != nil && r.Raw(), true
+			}
+		}
+	}
+	return "", false, false
+}
+
+// helper function for runDirective
+// defines the list of the #foreach and, if there are records in it, enters
+// the block with the first record in scope. Otherwise the block is skipped.
+func (c *nonConvertedFile) enterForeach(loop *foreachBlock) error {
+	def, _, err := c.define(loop.variable)
+	if err != nil {
+		return err
+	}
+	list, ok := def.(ListDefinition)
+	if !ok || list.Len() < 0 {
+		_ = def.Close()
+		oerr := NewError(errNotAList)
+		oerr.SetSubjectf("%s %s", loop.variable.fullName, loop.pos.ToString())
+		return oerr
+	}
+	if list.Len() == 0 {
+		_ = def.Close()
+		return c.jumpPast(loop.end)
+	}
+	c.scopes = append(c.scopes, &listScope{loop: loop, list: list})
+	return nil
+}
+
+// helper function for runDirective
+// called when the end of the block is read. Moves the source file back to
+// the start of the block with the next record in scope, or if there are no
+// records left, leaves the block.
+func (c *nonConvertedFile) continueForeach(loop *foreachBlock) error {
+	s := c.scopes[len(c.scopes)-1]
+	s.index++
+	if s.index < s.list.Len() {
+		return c.jumpBackTo(loop.pos)
+	}
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	return s.list.Close()
+}
@@ -0,0 +1,242 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordList(t *testing.T) {
+	list := RecordList{
+		{"Title": "first", "Link": "/1"},
+		{"Title": "second"},
+	}
+	if list.Len() != 2 {
+		t.Errorf("Len was %d, expected 2", list.Len())
+	}
+	if v, ok := list.Field(0, "Link"); !ok || v != "/1" {
+		t.Errorf("Field(0, Link) was %q, %v", v, ok)
+	}
+	if v, ok := list.Field(1, "Link"); ok {
+		t.Errorf("Field(1, Link) was %q, expected it to be missing", v)
+	}
+	if n, err := list.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Errorf("Read returned %d, %v, expected it to be empty", n, err)
+	}
+}
+
+// notAList is a ListDefinition whose Len says that it isn't one.
+type notAList struct {
+	NormalDefinition
+}
+
+func (notAList) Len() int {
+	return -1
+}
+
+func (notAList) Field(int, string) (string, bool) {
+	return "", false
+}
+
+// rawList is a RecordList that is not to be escaped.
+type rawList struct {
+	RecordList
+}
+
+func (rawList) Raw() bool {
+	return true
+}
+
+func TestForeach(t *testing.T) {
+	lists := map[string]vorlageproc.Definition{
+		"Posts": RecordList{
+			{"Title": "<first>", "Link": "/1"},
+			{"Title": "second", "Link": "/2"},
+		},
+		"Tags":  RecordList{{"Tag": "a"}, {"Tag": "b"}},
+		"Empty": RecordList{},
+		"Raw":   rawList{RecordList{{"Title": "<b>raw</b>"}}},
+		"Text":  &NormalDefinition{value: "text"},
+		"Not":   &notAList{},
+	}
+	proc := &testProcessor{
+		info:    vorlageproc.ProcessorInfo{Name: "blog"},
+		defines: map[string]func(vorlageproc.DefineInfo) vorlageproc.Definition{},
+	}
+	for name, def := range lists {
+		def := def
+		proc.info.Variables = append(proc.info.Variables,
+			vorlageproc.ProcessorVariable{Name: name})
+		proc.defines[name] = func(vorlageproc.DefineInfo) vorlageproc.Definition {
+			return def
+		}
+	}
+
+	tests := []struct {
+		name   string
+		files  map[string]string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "records",
+			files: map[string]string{"doc.html": "<ul>\n#foreach $(blog.Posts)\n" +
+				"<li>$(Title) $(Link)</li>\n#endforeach\n</ul>\n"},
+			output: "<ul>\n<li>&lt;first&gt; /1</li>\n<li>second /2</li>\n</ul>\n"},
+		{name: "fields over definitions",
+			files: map[string]string{"doc.html": "#define $(Title) defined\n" +
+				"#foreach $(blog.Tags)\n$(Tag) $(Title)\n#endforeach\n$(Title)\n"},
+			output: "a defined\nb defined\ndefined\n"},
+		{name: "nested",
+			files: map[string]string{"doc.html": "#foreach $(blog.Posts)\n" +
+				"#foreach $(blog.Tags)\n$(Link)$(Tag) \n#endforeach\n#endforeach\n"},
+			output: "/1a \n/1b \n/2a \n/2b \n"},
+		{name: "inner-most first",
+			files: map[string]string{"doc.html": "#foreach $(blog.Posts)\n" +
+				"#foreach $(blog.Raw)\n$(Title)\n#endforeach\n#endforeach\n"},
+			output: "<b>raw</b>\n<b>raw</b>\n"},
+		{name: "included inside of the block",
+			files: map[string]string{
+				"doc.html":  "#foreach $(blog.Tags)\n#include tag.html\n#endforeach\n",
+				"tag.html":  "[$(Tag)]$(#include more.html)\n",
+				"more.html": "($(Tag))",
+			},
+			output: "[a](a)\n[b](b)\n"},
+		{name: "empty",
+			files: map[string]string{"doc.html": "before\n#foreach $(blog.Empty)\n" +
+				"$(Title)\n#endforeach\nafter\n"},
+			output: "before\nafter\n"},
+		{name: "not a list",
+			files: map[string]string{"doc.html": "#foreach $(blog.Text)\n" +
+				"#endforeach\n"},
+			fails: errNotAList},
+		{name: "list says it isn't one",
+			files: map[string]string{"doc.html": "#foreach $(blog.Not)\n" +
+				"#endforeach\n"},
+			fails: errNotAList},
+		{name: "never ended",
+			files: map[string]string{"doc.html": "#foreach $(blog.Posts)\n"},
+			fails: errUnterminatedBlock},
+		{name: "not a variable",
+			files: map[string]string{"doc.html": "#foreach Posts\n#endforeach\n"},
+			fails: "#foreach must be given a single variable"},
+	}
+	for _, test := range tests {
+		c := newTestCompiler(proc)
+		c.AutoEscape = DefaultAutoEscape
+		out, err := compileFiles(t, c, test.files, "doc.html", nil)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.fails, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
+
+// a C processor with a single list variable (list.Posts) for
+// TestCListDefinition.
+const testCListProcessor = `#include "processor-interface.h"
+#include <string.h>
+
+static const char *titles[] = {"first", "<second>"};
+static const vorlage_proc_variable variables[] = {{"Posts", "", 0, 0, 0, 0}};
+static vorlage_proc_action noactions[1];
+
+vorlage_proc_info vorlage_proc_startup() {
+	vorlage_proc_info info = {"", 0, 0, 0, 0, variables, 1};
+	return info;
+}
+vorlage_proc_actions vorlage_proc_onrequest(const vorlage_proc_requestinfo rinfo, void **context) {
+	vorlage_proc_actions actions = {noactions, 0};
+	return actions;
+}
+void *vorlage_proc_define(const vorlage_proc_defineinfo dinfo, void *context) {
+	return (void *)titles;
+}
+void vorlage_proc_onfinish(const vorlage_proc_requestinfo rinfo, void *context) {}
+int vorlage_proc_shutdown() { return 0; }
+int vorlage_proc_definer_read(void *definer, char *buf, size_t size) { return -2; }
+int vorlage_proc_definer_reset(void *definer) { return 0; }
+int vorlage_proc_definer_close(void *definer) { return 0; }
+
+int vorlage_proc_definer_len(void *definer) { return 2; }
+const char *vorlage_proc_definer_field(void *definer, int index, const char *name) {
+	if (strcmp(name, "Title") != 0) {
+		return NULL;
+	}
+	return ((const char **)definer)[index];
+}
+`
+
+func TestCListDefinition(t *testing.T) {
+	// definers of processors that don't define the optional functions are
+	// not lists.
+	d := descriptorReader{c: &cProc{}}
+	if d.Len() != -1 {
+		t.Errorf("Len was %d without vorlage_proc_definer_len", d.Len())
+	}
+	if _, ok := d.Field(0, "Title"); ok {
+		t.Errorf("Field was found without vorlage_proc_definer_field")
+	}
+	if d.Raw() {
+		t.Errorf("Raw was true without vorlage_proc_definer_raw")
+	}
+
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler to build the processor with")
+	}
+	dir, err := ioutil.TempDir("", "vorlage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "list.c")
+	lib := filepath.Join(dir, "liblist.so")
+	if err = ioutil.WriteFile(src, []byte(testCListProcessor), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(cc, "-shared", "-fPIC",
+		"-Ivorlage-interface/shared-library", "-o", lib, src).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build the processor: %s\n%s", err, out)
+	}
+	proc, err := dlOpen(lib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.procname = "list"
+	if err = proc.loadVorlageSymbols(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := proc.Startup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Compiler{ContentMacros: true, AutoEscape: DefaultAutoEscape}
+	c.processors = []vorlageproc.Processor{proc}
+	c.processorInfos = []vorlageproc.ProcessorInfo{info}
+	output, err := compileFiles(t, c, map[string]string{"doc.html": "" +
+		"#foreach $(list.Posts)\n<li>$(Title)$(Link|)</li>\n#endforeach\n"},
+		"doc.html", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "<li>first</li>\n<li>&lt;second&gt;</li>\n"
+	if output != expected {
+		t.Errorf("got %q, expected %q", output, expected)
+	}
+}
@@ -0,0 +1,225 @@
+package vorlage
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strings"
+)
+
+const MacroQuote = '"'
+const MacroEscape = '\\'
+const MacroHeredocPrefix = "<<"
+
+// helper-function for scanMaco
+// splits the line of a macro into its arguments. Arguments are separated by
+// one or more MacroArgument. If the macro's arguments are a list (see
+// hasListArguments), any part of an argument can be wrapped in MacroQuote to
+// keep the spaces inside of it, and inside of the quotes MacroEscape can be
+// used to write a quote (\"), a backslash (\\), a newline (\n), or a tab
+// (\t). The arguments of every other macro (ie #define) are split as they
+// are, quotes and all (see macoPos.value).
+//
+// starts is where each argument starts in line.
+//
+// If the last argument is an unquoted MacroHeredocPrefix followed by a word
+// (ie, <<END) then it is removed from the arguments and the word is returned
+// as heredoc. See Document.scanHeredoc.
+func splitMacroArguments(line string) (args []string, starts []int,
+	heredoc string, oerr *Error) {
+	quotes := hasListArguments(macroName([]byte(line)))
+	args, starts, lastQuoted, oerr := splitArguments(line, quotes)
+	if oerr != nil {
+		return args, starts, "", oerr
+	}
+
+	if len(args) > 1 && !lastQuoted {
+		last := args[len(args)-1]
+		if strings.HasPrefix(last, MacroHeredocPrefix) &&
+			len(last) > len(MacroHeredocPrefix) {
+			heredoc = last[len(MacroHeredocPrefix):]
+			args = args[:len(args)-1]
+			starts = starts[:len(starts)-1]
+		}
+	}
+	return args, starts, heredoc, nil
+}
+
+// helper-function for splitMacroArguments
+// does the actual splitting. If quotes is false, MacroQuote and MacroEscape
+// are just like any other character. lastQuoted is true if any part of the
+// last argument was in quotes.
+func splitArguments(line string, quotes bool) (args []string, starts []int,
+	lastQuoted bool, oerr *Error) {
+	var arg strings.Builder
+	var inArg, quoted, argQuoted bool
+
+	args = []string{}
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		if !inArg && (quoted || ch != MacroArgument) {
+			starts = append(starts, i)
+		}
+		switch {
+		case quoted && ch == MacroEscape && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 'n':
+				arg.WriteByte('\n')
+			case 't':
+				arg.WriteByte('\t')
+			default:
+				arg.WriteByte(line[i])
+			}
+		case quotes && ch == MacroQuote:
+			quoted = !quoted
+			inArg = true
+			argQuoted = true
+		case !quoted && ch == MacroArgument:
+			if inArg {
+				args = append(args, arg.String())
+				lastQuoted = argQuoted
+				arg.Reset()
+			}
+			inArg = false
+			argQuoted = false
+		default:
+			arg.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if quoted {
+		oerr = NewError(errUnterminatedQuote)
+		oerr.SetSubject(line)
+		return args, starts, false, oerr
+	}
+	if inArg {
+		args = append(args, arg.String())
+		lastQuoted = argQuoted
+	}
+	return args, starts, lastQuoted, nil
+}
+
+// returns true if the arguments of the macro are a list of things (ie the
+// paths of an #include) which can be quoted. Definitions (#define, #default,
+// #override, #local and #macro), the target of a #redirect (which can have
+// variables in it, just like a definition) and anything that isn't a macro
+// (ie the title of a markdown file) are not.
+func hasListArguments(name string) bool {
+	switch name {
+	case UndefStr, InputStr, StatusStr, HeaderStr, ContentTypeStr,
+		TrimStr, ImportStr, PrependStr, AppendStr, ExtendsStr:
+		return true
+	}
+	return isBodyMacro(name)
+}
+
+// returns the arguments from index from onwards as a single value. For a
+// definition this is the text as it was written, meaning the spaces and
+// quotes inside of it are kept (ie, #define $(Link) <a href="/">home</a>),
+// unless all of it is wrapped in MacroQuote (see unquoteValue). For any
+// other macro (see hasListArguments) it's the arguments joined with a single
+// MacroArgument, so quotes are needed to keep more than one space. A heredoc
+// is always the lines as they were written.
+func (m macoPos) value(from int) string {
+	if m.heredoc || from >= len(m.argStarts) || hasListArguments(m.args[0]) {
+		return strings.Join(m.args[from:], string(MacroArgument))
+	}
+	value := strings.TrimRight(m.line[m.argStarts[from]:], string(MacroArgument))
+	if unquoted, ok := unquoteValue(value); ok {
+		return unquoted
+	}
+	return value
+}
+
+// helper-function for macoPos.value
+// if value starts with MacroQuote and the quote isn't ended until the very
+// end of it (ie "a \"b\""), it's read the same way as a quoted argument:
+// the quotes are removed and the escapes inside of them are written out.
+// Otherwise ok is false, so text such as 5" screen or "a" "b" is left as is.
+func unquoteValue(value string) (unquoted string, ok bool) {
+	if len(value) < 2 || value[0] != MacroQuote {
+		return value, false
+	}
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case MacroEscape:
+			i++
+		case MacroQuote:
+			if i != len(value)-1 {
+				return value, false
+			}
+			args, _, _, _ := splitArguments(value, true)
+			return args[0], true
+		}
+	}
+	return value, false
+}
+
+// returns true if the argument at index i was written in quotes.
+func (m macoPos) quoted(i int) bool {
+	return i < len(m.argStarts) && m.line[m.argStarts[i]] == MacroQuote
+}
+
+// helper-function for detectMacrosPositions and detectBodyMacros
+// scans the macro found at the start of buffer (which was read from at).
+// If the macro ends in a heredoc then every line after it up until the line
+// that only contains the heredoc's word is added as the last argument. Lines
+// will be the amount of lines the macro took up beyond its first.
+func (doc *Document) scanMacro(buffer []byte, at int64,
+	linenum uint) (pos macoPos, lines uint, oerr *Error) {
+	pos, heredoc, oerr := scanMaco(buffer, at, linenum)
+	if oerr != nil || heredoc == "" {
+		return pos, 0, oerr
+	}
+	lines, oerr = doc.scanHeredoc(&pos, heredoc)
+	return pos, lines, oerr
+}
+
+// helper-function for scanMacro
+// reads the lines after pos until a line that is just the word is found. The
+// lines (without the last newline) are appended to pos' arguments and pos'
+// length is extended to include them and the ending line.
+func (doc *Document) scanHeredoc(pos *macoPos, word string) (lines uint,
+	oerr *Error) {
+	start := int64(pos.charPos) + int64(pos.length)
+	reader := bufio.NewReader(io.NewSectionReader(doc.rawFile, start,
+		math.MaxInt64-start))
+	var value strings.Builder
+	for {
+		line, err := reader.ReadString(EndOfLine[len(EndOfLine)-1])
+		if err != nil && err != io.EOF {
+			oerr = &Error{}
+			oerr.ErrStr = errFailedToReadBytes
+			oerr.SetBecause(NewError(err.Error()))
+			return lines, oerr
+		}
+		if line == "" && err == io.EOF {
+			oerr = NewError(errUnterminatedHeredoc)
+			oerr.SetSubjectf("%s%s %s", MacroHeredocPrefix, word, pos.ToString())
+			return lines, oerr
+		}
+		lines++
+		pos.length += uint(len(line))
+		if strings.TrimSuffix(line, EndOfLine) == word {
+			break
+		}
+		value.WriteString(line)
+	}
+	pos.args = append(pos.args, strings.TrimSuffix(value.String(), EndOfLine))
+	pos.heredoc = true
+	return lines, nil
+}
+
+// returns the name of the macro found at the start of buffer (everything up
+// to the first MacroArgument or EndOfLine).
+func macroName(buffer []byte) string {
+	line := string(buffer)
+	if i := strings.Index(line, EndOfLine); i != -1 {
+		line = line[:i]
+	}
+	if i := strings.IndexByte(line, MacroArgument); i != -1 {
+		line = line[:i]
+	}
+	return line
+}
@@ -0,0 +1,158 @@
+package vorlage
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSplitMacroArguments(t *testing.T) {
+	tests := []struct {
+		line    string
+		args    []string
+		heredoc string
+		value   string // value(2), if there are more than 2 arguments
+		fails   bool
+	}{
+		{line: `#include a.html`,
+			args: []string{"#include", "a.html"}},
+		{line: `#include   "my file.html"   b.html `,
+			args:  []string{"#include", "my file.html", "b.html"},
+			value: "b.html"},
+		{line: `#include "a \"b\" \\ \n\tc"`,
+			args: []string{"#include", "a \"b\" \\ \n\tc"}},
+		{line: `#include pre"fix "post`,
+			args: []string{"#include", "prefix post"}},
+		{line: `#include "a.html`,
+			fails: true},
+		{line: `#include "<<END"`,
+			args: []string{"#include", "<<END"}},
+		{line: `#header X-Note: "a  b"`,
+			args:  []string{"#header", "X-Note:", "a  b"},
+			value: "a  b"},
+
+		// definitions are kept as they were written unless all of the value
+		// is in quotes.
+		{line: `#define $(Link) <a href="/">home</a>`,
+			args:  []string{"#define", "$(Link)", `<a`, `href="/">home</a>`},
+			value: `<a href="/">home</a>`},
+		{line: `#define $(Q) 5" screen  `,
+			args:  []string{"#define", "$(Q)", `5"`, "screen"},
+			value: `5" screen`},
+		{line: `#define $(A) "two  spaced"`,
+			args:  []string{"#define", "$(A)", `"two`, `spaced"`},
+			value: "two  spaced"},
+		{line: `#define $(A) "a \"b\""`,
+			args:  []string{"#define", "$(A)", `"a`, `\"b\""`},
+			value: `a "b"`},
+		{line: `#define $(A) " \\ \n\t" `,
+			args:  []string{"#define", "$(A)", `"`, `\\`, `\n\t"`},
+			value: " \\ \n\t"},
+		{line: `#define $(A) "a" "b"`,
+			args:  []string{"#define", "$(A)", `"a"`, `"b"`},
+			value: `"a" "b"`},
+		{line: `#define $(A) "a"b`,
+			args:  []string{"#define", "$(A)", `"a"b`},
+			value: `"a"b`},
+		{line: `#define $(A) "a\"`,
+			args:  []string{"#define", "$(A)", `"a\"`},
+			value: `"a\"`},
+		{line: `#redirect /a/$(t.x y="1 2") 301`,
+			args:  []string{"#redirect", "/a/$(t.x", `y="1`, `2")`, "301"},
+			value: `y="1 2") 301`},
+		{line: `# Title "quoted`,
+			args: []string{"#", "Title", `"quoted`}, value: `"quoted`},
+
+		// heredocs
+		{line: `#define $(B) <<END`,
+			args: []string{"#define", "$(B)"}, heredoc: "END"},
+		{line: `#define $(B) "<<END"`,
+			args: []string{"#define", "$(B)", `"<<END"`}, value: "<<END"},
+		{line: `#define $(B) <<`,
+			args: []string{"#define", "$(B)", "<<"}, value: "<<"},
+		{line: `#raw <<END`,
+			args: []string{"#raw"}, heredoc: "END"},
+		{line: `#endraw`,
+			args: []string{"#endraw"}},
+	}
+	for _, test := range tests {
+		args, starts, heredoc, err := splitMacroArguments(test.line)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.line, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.args) || heredoc != test.heredoc {
+			t.Errorf("%s: got %q (heredoc %q), expected %q (heredoc %q)",
+				test.line, args, heredoc, test.args, test.heredoc)
+			continue
+		}
+		if len(starts) != len(args) {
+			t.Errorf("%s: %d starts for %d arguments", test.line,
+				len(starts), len(args))
+			continue
+		}
+		m := macoPos{args: args, argStarts: starts, line: test.line}
+		if len(args) > 2 && m.value(2) != test.value {
+			t.Errorf("%s: value was %q, expected %q", test.line, m.value(2),
+				test.value)
+		}
+	}
+}
+
+func TestScanHeredoc(t *testing.T) {
+	tests := []struct {
+		file   string
+		value  string
+		lines  uint
+		length int
+		fails  bool
+	}{
+		{file: "#define $(B) <<END\none\n\n  two\nEND\nafter\n",
+			value: "one\n\n  two", lines: 4, length: 34},
+		{file: "#define $(B) <<END\nEND\n",
+			value: "", lines: 1, length: 23},
+		{file: "#define $(B) <<END\nline\nEND",
+			value: "line", lines: 2, length: 27},
+		{file: "#define $(B) <<END\n END\nENDS\nEND\n",
+			value: " END\nENDS", lines: 3, length: 33},
+		{file: "#define $(B) <<END\nline\n",
+			fails: true},
+	}
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "heredoc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err = f.WriteString(test.file); err != nil {
+			t.Fatal(err)
+		}
+
+		doc := &Document{rawFile: f}
+		pos, lines, oerr := doc.scanMacro([]byte(test.file), 0, 1)
+		if test.fails {
+			if oerr == nil {
+				t.Errorf("%q: expected an error", test.file)
+			}
+			continue
+		}
+		if oerr != nil {
+			t.Errorf("%q: %s", test.file, oerr)
+			continue
+		}
+		if !pos.heredoc || pos.value(2) != test.value || lines != test.lines ||
+			pos.length != uint(test.length) {
+			t.Errorf("%q: got %q (%d lines, length %d), expected %q "+
+				"(%d lines, length %d)", test.file, pos.value(2), lines,
+				pos.length, test.value, test.lines, test.length)
+		}
+	}
+}
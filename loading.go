@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"sync/atomic"
@@ -16,13 +15,49 @@ import (
 const MacroArgument = ' ' //todo: just rename this to 'macrospace'
 const MacroPrefix = "#"
 const DefineStr = "#define"
+const MacroStr = "#macro"
+const DefaultStr = "#default"
+const OverrideStr = "#override"
+const UndefStr = "#undef"
+const LocalStr = "#local"
+const InputStr = "#input"
+const StatusStr = "#status"
+const HeaderStr = "#header"
+const ContentTypeStr = "#contenttype"
+const RedirectStr = "#redirect"
+const TrimStr = "#trim"
+const ImportStr = "#import"
 const PrependStr = "#prepend"
 const AppendStr = "#append"
+const IncludeStr = "#include"
+const IfStr = "#if"
+const IfdefStr = "#ifdef"
+const IfndefStr = "#ifndef"
+const ElifStr = "#elif"
+const ElseStr = "#else"
+const EndifStr = "#endif"
+const ForeachStr = "#foreach"
+const EndforeachStr = "#endforeach"
+const ExtendsStr = "#extends"
+const BlockStr = "#block"
+const EndblockStr = "#endblock"
+const RawStr = "#raw"
+const EndrawStr = "#endraw"
 const EndOfLine = "\n"
 const VariablePrefix = "$("
 const VariableSuffix = ")"
 const VariableProcessorSeporator = "."
-const VariableRegexp = `^(?:[a-z0-9]+\.)?[a-zA-Z0-9]+$`
+const VariableFallbackSeporator = "|"
+const VariableRegexp = `^(?:` + NameRegexp + `\.)?` + NameRegexp + `(?::[a-zA-Z0-9]+)*(?:(?: +` + VariableArgumentRegexp + `)+ *)?(?:\|.*)?$`
+
+// the arguments given to variables are either an input (ie limit=5 or
+// tag="not news") or a quoted string (ie "About me").
+const VariableArgumentRegexp = `(?:` + NameRegexp + `=(?:[^ "|]+|` + QuotedArgumentRegexp + `)|` + QuotedArgumentRegexp + `)`
+const QuotedArgumentRegexp = `"(?:[^"\\|]|\\[^|])*"`
+
+// variable, processor, and #macro parameter names are made up of unicode
+// letters (and their marks), digits, '_' and '-'.
+const NameRegexp = `[\p{L}\p{M}\p{N}_\-]+`
 const MacroMaxLength = 1024
 
 var variableRegexpProc = regexp.MustCompile(VariableRegexp)
@@ -31,6 +66,29 @@ type NormalDefinition struct {
 	variable string
 	value    string
 	seeker   int
+
+	// only used by fields of lists (see ListDefinition), as they are defined
+	// by processors.
+	raw bool
+
+	// the names of the parameters if this was defined by #macro, nil
+	// otherwise.
+	params []string
+
+	// the delimiters of the document it was defined in, which is what
+	// the variables in its value are written with.
+	delims Delimiters
+
+	// which macro defined it, used to decide which definition is kept when
+	// a variable is defined more than once (see addDefinition).
+	kind definitionKind
+
+	// how many documents the document it was defined in is away from the
+	// root document (0 being the root itself).
+	depth int
+
+	// the document (and line) that defined it, for debugging.
+	source string
 }
 
 func (d *NormalDefinition) Close() error {
@@ -79,6 +137,10 @@ func (d *NormalDefinition) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+func (d *NormalDefinition) Raw() bool {
+	return d.raw
+}
+
 func (d *NormalDefinition) Reset() error {
 	d.seeker = 0
 	return nil
@@ -89,6 +151,12 @@ type macoPos struct {
 	charPos uint64
 	length  uint
 	linenum uint
+
+	// the first line of the macro as it was written and where each of args
+	// start in it. heredoc is true if the last of args is a heredoc.
+	line      string
+	argStarts []int
+	heredoc   bool
 }
 
 func (m macoPos) ToString() string {
@@ -104,6 +172,10 @@ type Document struct {
 
 	path string
 
+	// what the variables in this document start and end with (see
+	// Compiler.Delimiters).
+	delimiters Delimiters
+
 	// will point to the root's. will not be nil after the document
 	// is loaded. only used when the document is being read.
 	// This map will have the same keys as streamArguments. The purpose of this
@@ -122,9 +194,29 @@ type Document struct {
 	// then this points to the root's allDefinitions
 	allDefinitions *[]NormalDefinition
 
+	// the #local definitions of this document, only visible to this
+	// document and the documents it includes.
+	localDefinitions []NormalDefinition
+
+	// the inputs this document expects to be given (#input).
+	inputs []*documentInput
+
+	// the #status, #header and #contenttype macros of this document.
+	responses []responseMacro
+
+	// nil if the document doesn't #redirect.
+	redirect *redirectMacro
+
+	// true if the document has #trim, see Document.blankLines.
+	trim bool
+
 	allIncluded *[]*Document // if root != nil,
 	// then this points to the root's allIncluded
 
+	// the directories that were looked in for documents to #prepend or
+	// #append with a pattern (see GetDependants). Points to the root's.
+	dependantDirs *[]string
+
 	documentEOF bool // while reading, will be set to true if the document (
 	// plus prepends and appends) is at End of file
 	convertedFileDoneReading bool // set to true if the (
@@ -141,6 +233,10 @@ type Document struct {
 
 	macros []macoPos
 
+	// documents given by #import, only their macros are ran.
+	imports   []*Document // points to somewhere in allIncluded
+	importPos []*macoPos  // points to somewhere in macros
+
 	prepends            []*Document // points to somewhere in allIncluded
 	prependReadingIndex int
 	prependsPos         []*macoPos // points to somewhere in macros
@@ -149,8 +245,47 @@ type Document struct {
 	appendReadingIndex int
 	appendPos          []*macoPos // points to somewhere in macros
 
+	includes   []*Document // points to somewhere in allIncluded
+	includePos []*macoPos  // points to somewhere in macros
+
+	// the documents given to inline includes (ie "$(#include nav.html)")
+	// keyed by the path they were written with, which are found by
+	// checkVariables.
+	inlineIncludes map[string]*Document // points to somewhere in allIncluded
+	inlinePaths    []string
+
+	// the document given by #extends (points to somewhere in allIncluded),
+	// it's read in place of this document's content. extendedBy is the
+	// document that has this document as its layout.
+	layout     *Document
+	extendsPos *macoPos // points to somewhere in macros
+	extendedBy *Document
+
+	// every #block and #endblock found in the document. Both the #block and
+	// its #endblock point to the same block. blockNames has the same blocks
+	// by their names.
+	blocks     map[*macoPos]*namedBlock
+	blockNames map[string]*namedBlock
+
 	normalPos []*macoPos // points to somewhere in macros
 
+	// every #if, #ifdef, #ifndef, #elif, #else and #endif found in the
+	// document. The keys point to somewhere in macros.
+	conditionals map[*macoPos]*conditional
+
+	// every #foreach and #endforeach found in the document. Both the
+	// #foreach and its #endforeach point to the same block.
+	loops map[*macoPos]*foreachBlock
+
+	// every #raw (and the #endraw that ends it) in the document, keyed by
+	// the #raw.
+	verbatim map[*macoPos]*macoPos
+
+	// all macros that were found in the content of the document (after
+	// rawContentStart) rather than at the top of it. These are ran by
+	// the converted file as it gets to them. Points to somewhere in macros.
+	bodyPos []*macoPos
+
 	//variablePos []variablePos // note: these positions are in the CONVERTED
 	// file
 
@@ -219,6 +354,7 @@ func loadDocumentFromPath(path string,
 	doc.path = path
 	doc.convertedFileDoneReading = false
 	doc.compiler = compiler
+	doc.delimiters = compiler.delimitersFor(path)
 	// zero-out the variable detection buffer
 	for i := range doc.VariableDetectionBuffer {
 		doc.VariableDetectionBuffer[i] = 0
@@ -229,13 +365,18 @@ func loadDocumentFromPath(path string,
 		// this is the root documetn
 		doc.allDefinitions = doc.root.allDefinitions
 		doc.allIncluded = doc.root.allIncluded
+		doc.dependantDirs = doc.root.dependantDirs
 		doc.compRequest = doc.root.compRequest
 		doc.streamInputsUsed = doc.root.streamInputsUsed
 	} else {
 		// this is a child document
 		doc.root = doc
-		doc.allDefinitions = &[]NormalDefinition{}
+		// each request gets its own copy of the globals so reading them
+		// doesn't affect other requests.
+		globals := append([]NormalDefinition{}, request.globals...)
+		doc.allDefinitions = &globals
 		doc.allIncluded = &[]*Document{}
+		doc.dependantDirs = &[]string{}
 		doc.compRequest = request
 		doc.streamInputsUsed = make(map[string]string, len(request.allStreams))
 	}
@@ -283,38 +424,123 @@ func loadDocumentFromPath(path string,
 		return doc, oerr
 	}
 
+	Logger.Debugf("checking variables in '%s'", path)
+	err = doc.checkVariables()
+	if err != nil {
+		oerr.ErrStr = "failed to check variables"
+		oerr.SetBecause(err)
+		return doc, oerr
+	}
+
+	// run #imports
+	Logger.Debugf("importing %d documents to '%s'", len(doc.importPos), path)
+	doc.imports = make([]*Document, len(doc.importPos))
+	for i := 0; i < len(doc.importPos); i++ {
+		pos := doc.importPos[i]
+		inc, err := doc.include(strings.Join(pos.args[1:], " "))
+		if err != nil {
+			oerr.ErrStr = "failed to import document"
+			oerr.SetSubjectf("%s %s", path, pos.ToString())
+			oerr.SetBecause(err)
+			return doc, oerr
+		}
+		doc.imports[i] = inc
+	}
+
 	// run #prepends
 	Logger.Debugf("prepending %d documents to '%s'", len(doc.prependsPos), path)
-	doc.prepends = make([]*Document, len(doc.prependsPos))
+	doc.prepends = make([]*Document, 0, len(doc.prependsPos))
 	for i := 0; i < len(doc.prependsPos); i++ {
 		pos := doc.prependsPos[i]
-		inc, err := doc.include(strings.Join(pos.args[1:], " "))
+		incs, err := doc.includeAll(pos)
 		if err != nil {
 			oerr.ErrStr = "failed to prepend document"
 			oerr.SetBecause(err)
 			return doc, oerr
 		}
-		doc.prepends[i] = inc
+		doc.prepends = append(doc.prepends, incs...)
 	}
 
 	// run #appends
 	Logger.Debugf("appending %d documents to '%s'", len(doc.appendPos), path)
-	doc.appends = make([]*Document, len(doc.appendPos))
+	doc.appends = make([]*Document, 0, len(doc.appendPos))
 	for i := 0; i < len(doc.appendPos); i++ {
 		pos := doc.appendPos[i]
-		inc, err := doc.include(strings.Join(pos.args[1:], " "))
+		incs, err := doc.includeAll(pos)
 		if err != nil {
 			oerr.ErrStr = "failed to append document"
 			oerr.SetBecause(err)
 			return doc, oerr
 		}
-		doc.appends[i] = inc
+		doc.appends = append(doc.appends, incs...)
+	}
+
+	// run #includes
+	Logger.Debugf("including %d documents in '%s'", len(doc.includePos), path)
+	doc.includes = make([]*Document, len(doc.includePos))
+	for i := 0; i < len(doc.includePos); i++ {
+		pos := doc.includePos[i]
+		inc, err := doc.include(strings.Join(pos.args[1:], " "))
+		if err != nil {
+			oerr.ErrStr = "failed to include document"
+			oerr.SetSubjectf("%s %s", path, pos.ToString())
+			oerr.SetBecause(err)
+			return doc, oerr
+		}
+		doc.includes[i] = inc
+	}
+
+	// run inline includes
+	Logger.Debugf("including %d documents inline in '%s'", len(doc.inlinePaths), path)
+	doc.inlineIncludes = make(map[string]*Document, len(doc.inlinePaths))
+	for _, p := range doc.inlinePaths {
+		inc, err := doc.include(p)
+		if err != nil {
+			oerr.ErrStr = "failed to include document"
+			oerr.SetSubjectf("%s %s", path, p)
+			oerr.SetBecause(err)
+			return doc, oerr
+		}
+		doc.inlineIncludes[p] = inc
+	}
+
+	// run #extends
+	if doc.extendsPos != nil {
+		pos := doc.extendsPos
+		Logger.Debugf("extending '%s' in '%s'", strings.Join(pos.args[1:], " "), path)
+		inc, err := doc.include(strings.Join(pos.args[1:], " "))
+		if err != nil {
+			oerr.ErrStr = "failed to extend document"
+			oerr.SetSubjectf("%s %s", path, pos.ToString())
+			oerr.SetBecause(err)
+			return doc, oerr
+		}
+		doc.layout = inc
+		inc.extendedBy = doc
 	}
 
 	// normal definitions (#define)
 	Logger.Debugf("parsing %d normal define(s) '%s'", len(doc.normalPos), path)
 	for _, d := range doc.normalPos {
-		def, err := createNormalDefinition(d.args[1], strings.Join(d.args[2:], " "))
+		if d.args[0] == UndefStr {
+			doc.removeDefinition(doc.delimiters.canonical(d.args[1]),
+				path+" "+d.ToString())
+			continue
+		}
+
+		var def NormalDefinition
+		var err *Error
+		if d.args[0] == MacroStr {
+			def, err = createMacroDefinition(d, doc.delimiters)
+		} else {
+			def, err = createNormalDefinition(
+				doc.delimiters.canonical(d.args[1]), d.value(2))
+		}
+		// the value is read with the delimiters of this document.
+		def.delims = doc.delimiters
+		def.kind = definitionKinds[d.args[0]]
+		def.depth = doc.depth()
+		def.source = path + " " + d.ToString()
 		if err != nil {
 			oerr.ErrStr = "cannot parse definition"
 			oerr.SetSubjectf("%s %s", path, d.ToString())
@@ -322,7 +548,11 @@ func loadDocumentFromPath(path string,
 			return doc, oerr
 		}
 
-		err = doc.addDefinition(def)
+		if d.args[0] == LocalStr {
+			err = addDefinition(&doc.localDefinitions, def)
+		} else {
+			err = addDefinition(doc.allDefinitions, def)
+		}
 		if err != nil {
 			oerr.ErrStr = "failed to add normal definition"
 			oerr.SetSubjectf("%s '%s'", path, d.ToString())
@@ -360,61 +590,61 @@ func bytesAreString(buff []byte, str string, offset int) bool {
 // simply looks at the buffer and scans a macro out of it. It returns the
 // length of the line, and any possible error. If 0 length is returned,
 // no more macros are left to scan.
-// todo: capture sequencies ie: #include "this argument is in double quotes.txt"
 func scanMaco(buffer []byte, charsource int64,
-	linenum uint) (pos macoPos, oerr *Error) {
+	linenum uint) (pos macoPos, heredoc string, oerr *Error) {
 
 	// first off, do we even have a valid macro?
 	if !bytesAreString(buffer, MacroPrefix, 0) {
 		// no this isn't a macro... so we're done looking for macros.
 		pos.length = 0
-		return pos, nil
+		return pos, "", nil
 	}
 
 	// get length
 	pos.linenum = linenum
 	pos.charPos = uint64(charsource)
 	pos.length = uint(len(MacroPrefix)) // we skip scanning the macro prefix
+	var eolLength uint                  // stays 0 if the file ends on the macro
 	for ; pos.length < uint(len(buffer)); pos.length++ {
 		// grab the end of the line
 
 		// first see if we can get to '\n'...
 		if bytesAreString(buffer, EndOfLine, int(pos.length)) {
 			// cut out the end of the line
-			pos.length += uint(len(EndOfLine))
+			eolLength = uint(len(EndOfLine))
+			pos.length += eolLength
 			break
 		}
 	}
-	if pos.length <= uint(len(MacroPrefix)) {
+	if pos.length-eolLength <= uint(len(MacroPrefix)) {
 		oerr = &Error{}
 		oerr.ErrStr = "macro prefix detected but no macro present"
 		oerr.SetSubjectf(pos.ToString())
-		return pos, oerr
+		return pos, "", oerr
 	}
 
 	// todo: what if macro is to long
-	//append(pos.args, )
-	tmp := strings.Split(string(buffer[:pos.length-uint(len(EndOfLine))]),
-		string(MacroArgument))
-	pos.args = []string{}
-	for _, t := range tmp {
-		if t != "" {
-			pos.args = append(pos.args, t)
-		}
+	pos.line = string(buffer[:pos.length-eolLength])
+	pos.args, pos.argStarts, heredoc, oerr = splitMacroArguments(pos.line)
+	if oerr != nil {
+		oerr.SetSubjectf(pos.ToString())
+		return pos, "", oerr
 	}
-	return pos, nil
+	return pos, heredoc, nil
 }
 
 /*
  * Get's a list of all paths that are included in this document recursively.
- * Good to monitor changes.
+ * Good to monitor changes. The directories that #prepend and #append
+ * patterns (ie news/*.html) were matched in are included as well, as
+ * adding a file to them changes the document.
  */
 func (doc Document) GetDependants() []string {
-	ret := make([]string, len(*doc.allIncluded))
+	ret := make([]string, len(*doc.allIncluded), len(*doc.allIncluded)+len(*doc.dependantDirs))
 	for i, d := range *doc.allIncluded {
 		ret[i] = d.path
 	}
-	return ret
+	return append(ret, *doc.dependantDirs...)
 }
 
 // helper-function for loadDocumentFromPath
@@ -440,40 +670,213 @@ func (doc *Document) detectMacrosPositions() (oerr *Error) {
 			return oerr
 		}
 
-		pos, oerr := scanMaco(doc.MacroReadBuffer[:n], at, linenum)
+		pos, lines, oerr := doc.scanMacro(doc.MacroReadBuffer[:n], at, linenum)
 		if oerr != nil {
 			return oerr
 		}
-
-		if pos.length == 0 {
+		linenum += lines
+
+		// macros that are meant for the content (such as #include) end the
+		// top of the document, they are picked up again by detectBodyMacros
+		if pos.length == 0 ||
+			doc.compiler.ContentMacros && isBodyMacro(pos.args[0]) {
+			// #trim removes the blank lines between the macros and the
+			// content.
+			skipped, lines, oerr := doc.blankLines(at)
+			if oerr != nil {
+				return oerr
+			}
+			at += skipped
+			linenum += lines
 			doc.rawContentStart = at
 			Logger.Debugf("finished detecting macros in '%s'", doc.path)
-			return nil
+			if !doc.compiler.ContentMacros {
+				return nil
+			}
+			return doc.detectBodyMacros(at, linenum)
 		}
 
 		Logger.Debugf("detected macro '%s' in %s", pos.args[0], doc.path)
 		doc.macros = append(doc.macros, pos)
+		if pos.args[0] == TrimStr {
+			doc.trim = true
+		}
 
 		at += int64(pos.length)
 	}
 	return nil
 }
 
+// returns true if the macro name is one that can be used anywhere in the
+// document, which is none of them unless the compiler has ContentMacros set.
+func (doc *Document) isContentMacro(name string) bool {
+	if !doc.compiler.ContentMacros {
+		return false
+	}
+	switch name {
+	case DefineStr, MacroStr, DefaultStr, OverrideStr, UndefStr,
+		LocalStr, InputStr, StatusStr, HeaderStr, ContentTypeStr,
+		RedirectStr, ImportStr, PrependStr, AppendStr:
+		return true
+	}
+	return isBodyMacro(name)
+}
+
+// returns true if the macro name is one that is only of use within the
+// content of the document (ie, after the first line that isn't a macro).
+func isBodyMacro(name string) bool {
+	switch name {
+	case IncludeStr,
+		IfStr, IfdefStr, IfndefStr, ElifStr, ElseStr, EndifStr,
+		ForeachStr, EndforeachStr,
+		BlockStr, EndblockStr,
+		RawStr, EndrawStr:
+		return true
+	}
+	return false
+}
+
+// helper-function for detectMacrosPositions
+// continues on from the top of the document (at) and goes through every line
+// of the content looking for macros that are allowed in the content (see
+// isContentMacro). Every other line is left alone.
+func (doc *Document) detectBodyMacros(at int64, linenum uint) (oerr *Error) {
+	var lineStart = true // set to false if a line is longer than the buffer
+	var inRaw bool       // inside of a #raw, nothing but #endraw is a macro
+
+	for {
+		n, err := doc.rawFile.ReadAt(doc.MacroReadBuffer, at)
+		if err != nil && err != io.EOF {
+			oerr := &Error{}
+			oerr.ErrStr = errFailedToReadBytes
+			oerr.SetBecause(NewError(err.Error()))
+			return oerr
+		}
+		if n == 0 {
+			Logger.Debugf("finished detecting content macros in '%s'", doc.path)
+			return nil
+		}
+		buffer := doc.MacroReadBuffer[:n]
+
+		// only lines that start with a content macro's name are scanned, any
+		// other line is content no matter what its arguments look like.
+		if lineStart && bytesAreString(buffer, MacroPrefix, 0) &&
+			(inRaw && macroName(buffer) == EndrawStr ||
+				!inRaw && doc.isContentMacro(macroName(buffer))) {
+			pos, lines, oerr := doc.scanMacro(buffer, at, linenum)
+			if oerr != nil {
+				return oerr
+			}
+			inRaw = pos.args[0] == RawStr
+			if !inRaw {
+				// #trim removes the blank lines after the macro as well
+				// (but not the ones inside of a #raw).
+				skipped, blank, oerr := doc.blankLines(at + int64(pos.length))
+				if oerr != nil {
+					return oerr
+				}
+				pos.length += uint(skipped)
+				lines += blank
+			}
+			Logger.Debugf("detected content macro '%s' in %s (%s)",
+				pos.args[0], doc.path, pos.ToString())
+			doc.macros = append(doc.macros, pos)
+			at += int64(pos.length)
+			linenum += 1 + lines
+			continue
+		}
+
+		// this line is just content. skip to the next one.
+		eol := strings.Index(string(buffer), EndOfLine)
+		if eol == -1 {
+			// this line is longer than the buffer, keep looking for its end.
+			lineStart = false
+			at += int64(n)
+			continue
+		}
+		lineStart = true
+		at += int64(eol + len(EndOfLine))
+		linenum++
+	}
+}
+
 func (doc *Document) processMacros() (oerr *Error) {
 	doc.normalPos = []*macoPos{}
+	doc.importPos = []*macoPos{}
 	doc.prependsPos = []*macoPos{}
 	doc.appendPos = []*macoPos{}
+	doc.conditionals = make(map[*macoPos]*conditional)
+	doc.loops = make(map[*macoPos]*foreachBlock)
+	doc.blocks = make(map[*macoPos]*namedBlock)
+	doc.blockNames = make(map[string]*namedBlock)
+	doc.verbatim = make(map[*macoPos]*macoPos)
+	var openBlocks []*macoPos // the #if's and #foreach's we're currently inside of
 	for i := 0; i < len(doc.macros); i++ {
 		m := &(doc.macros[i])
+		if !doc.compiler.ContentMacros && isBodyMacro(m.args[0]) {
+			// without ContentMacros these are left alone like any other
+			// macro that isn't known, so documents that have lines such as
+			// "#include <stdio.h>" at the top still compile.
+			continue
+		}
 		switch m.args[0] {
-		case DefineStr:
+		case RedirectStr:
+			if doc.redirect != nil {
+				oerr := NewError("document can only #redirect once")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			redirect, oerr := parseRedirect(m)
+			if oerr != nil {
+				return oerr
+			}
+			doc.redirect = redirect
+			break
+		case StatusStr, HeaderStr, ContentTypeStr:
+			response, oerr := parseResponseMacro(m)
+			if oerr != nil {
+				return oerr
+			}
+			doc.responses = append(doc.responses, response)
+			break
+		case TrimStr:
+			if len(m.args) != 1 {
+				oerr := NewError("#trim doesn't take any arguments")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			break
+		case InputStr:
+			input, oerr := parseInput(m)
+			if oerr != nil {
+				return oerr
+			}
+			doc.inputs = append(doc.inputs, input)
+			break
+		case UndefStr:
+			if len(m.args) != 2 {
+				oerr := NewError("#undef must be given a single variable")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			doc.normalPos = append(doc.normalPos, m)
+			break
+		case DefineStr, MacroStr, DefaultStr, OverrideStr, LocalStr:
 			if len(m.args) < 3 {
-				oerr := NewError("#define missing arguments")
+				oerr := NewError(m.args[0] + " missing arguments")
 				oerr.SetSubject(m.ToString())
 				return oerr
 			}
 			doc.normalPos = append(doc.normalPos, m)
 			break
+		case ImportStr:
+			if len(m.args) < 2 {
+				oerr := NewError("#import missing arguments")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			doc.importPos = append(doc.importPos, m)
+			break
 		case PrependStr:
 			if len(m.args) < 2 {
 				oerr := NewError("#prepend missing arguments")
@@ -490,6 +893,168 @@ func (doc *Document) processMacros() (oerr *Error) {
 			}
 			doc.appendPos = append(doc.appendPos, m)
 			break
+		case IncludeStr:
+			if len(m.args) < 2 {
+				oerr := NewError("#include missing arguments")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			doc.includePos = append(doc.includePos, m)
+			break
+		case ExtendsStr:
+			if len(m.args) < 2 {
+				oerr := NewError("#extends missing arguments")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			if doc.extendsPos != nil {
+				oerr := NewError("document can only #extends one layout")
+				oerr.SetSubject(m.ToString())
+				return oerr
+			}
+			doc.extendsPos = m
+			break
+		case BlockStr:
+			block, oerr := parseBlock(doc, m)
+			if oerr != nil {
+				return oerr
+			}
+			doc.blocks[m] = block
+			doc.blockNames[block.name] = block
+			openBlocks = append(openBlocks, m)
+			break
+		case EndblockStr:
+			var block *namedBlock
+			if len(openBlocks) != 0 {
+				block = doc.blocks[openBlocks[len(openBlocks)-1]]
+			}
+			if block == nil {
+				oerr := NewError(errUnmatchedBlock)
+				oerr.SetSubjectf("%s %s", m.args[0], m.ToString())
+				return oerr
+			}
+			block.end = m
+			doc.blocks[m] = block
+			openBlocks = openBlocks[:len(openBlocks)-1]
+			break
+		case RawStr:
+			// nothing is detected inside of a #raw (see detectBodyMacros)
+			// so it's ended by the very next macro.
+			if i+1 == len(doc.macros) || doc.macros[i+1].args[0] != EndrawStr {
+				oerr := NewError(errUnterminatedBlock)
+				oerr.SetSubjectf("%s %s", m.args[0], m.ToString())
+				return oerr
+			}
+			doc.verbatim[m] = &(doc.macros[i+1])
+			break
+		case EndrawStr:
+			if i == 0 || doc.verbatim[&(doc.macros[i-1])] != m {
+				oerr := NewError(errUnmatchedBlock)
+				oerr.SetSubjectf("%s %s", m.args[0], m.ToString())
+				return oerr
+			}
+			break
+		case IfStr, IfdefStr, IfndefStr:
+			cond, oerr := parseCondition(m, doc.delimiters)
+			if oerr != nil {
+				return oerr
+			}
+			doc.conditionals[m] = cond
+			openBlocks = append(openBlocks, m)
+			break
+		case ElifStr, ElseStr, EndifStr:
+			var block *conditional
+			if len(openBlocks) != 0 {
+				block = doc.conditionals[openBlocks[len(openBlocks)-1]]
+			}
+			if block == nil {
+				oerr := NewError(errUnmatchedBlock)
+				oerr.SetSubjectf("%s %s", m.args[0], m.ToString())
+				return oerr
+			}
+			last := block.lastBranch()
+			if last.pos.args[0] == ElseStr && m.args[0] != EndifStr {
+				oerr := NewError(errUnmatchedBlock)
+				oerr.SetSubjectf("%s after %s %s", m.args[0], ElseStr, m.ToString())
+				return oerr
+			}
+			cond := &conditional{pos: m}
+			if m.args[0] == ElifStr {
+				var oerr *Error
+				cond, oerr = parseCondition(m, doc.delimiters)
+				if oerr != nil {
+					return oerr
+				}
+			}
+			doc.conditionals[m] = cond
+			last.next = cond
+			if m.args[0] == EndifStr {
+				// the block is finished, let every branch know where it ends.
+				for b := block; b != nil; b = b.next {
+					b.end = m
+				}
+				openBlocks = openBlocks[:len(openBlocks)-1]
+			}
+			break
+		case ForeachStr:
+			loop, oerr := parseForeach(m, doc.delimiters)
+			if oerr != nil {
+				return oerr
+			}
+			doc.loops[m] = loop
+			openBlocks = append(openBlocks, m)
+			break
+		case EndforeachStr:
+			var loop *foreachBlock
+			if len(openBlocks) != 0 {
+				loop = doc.loops[openBlocks[len(openBlocks)-1]]
+			}
+			if loop == nil {
+				oerr := NewError(errUnmatchedBlock)
+				oerr.SetSubjectf("%s %s", m.args[0], m.ToString())
+				return oerr
+			}
+			loop.end = m
+			doc.loops[m] = loop
+			openBlocks = openBlocks[:len(openBlocks)-1]
+			break
+		}
+		if int64(m.charPos) >= doc.rawContentStart {
+			doc.bodyPos = append(doc.bodyPos, m)
+		}
+	}
+	if len(openBlocks) != 0 {
+		m := openBlocks[len(openBlocks)-1]
+		oerr := NewError(errUnterminatedBlock)
+		oerr.SetSubjectf("%s %s", m.args[0], m.ToString())
+		return oerr
+	}
+	return nil
+}
+
+// returns the document that was included by the #include macro at pos.
+func (doc *Document) includedAt(pos *macoPos) *Document {
+	for i := range doc.includePos {
+		if doc.includePos[i] == pos {
+			return doc.includes[i]
+		}
+	}
+	return nil
+}
+
+// returns the document that was included inline with path. The variable
+// may not have been written in doc (ie it's in the value of a #define from
+// another document) so all of the documents are looked at, doc first.
+func (doc *Document) includedInline(path string) *Document {
+	if inc, ok := doc.inlineIncludes[path]; ok {
+		return inc
+	}
+	if inc, ok := doc.root.inlineIncludes[path]; ok {
+		return inc
+	}
+	for _, d := range *doc.allIncluded {
+		if inc, ok := d.inlineIncludes[path]; ok {
+			return inc
 		}
 	}
 	return nil
@@ -497,17 +1062,17 @@ func (doc *Document) processMacros() (oerr *Error) {
 
 // prevents duplicate opens
 func (doc *Document) include(path string) (incdoc *Document, oerr *Error) {
-	relPath := filepath.Dir(doc.path) + string(filepath.Separator) + path
-
-	var stat syscall.Stat_t
-	cerr := syscall.Stat(relPath, &stat)
-	if cerr != nil {
-		oerr := NewError("failed to stat document")
-		oerr.SetSubject(relPath)
-		oerr.SetBecause(NewError(cerr.Error()))
+	relPath, stat, oerr := doc.resolveInclude(path)
+	if oerr != nil {
 		return nil, oerr
 	}
+	return doc.includeResolved(path, relPath, stat)
+}
 
+// same as include but relPath (which was written as path) has already been
+// found.
+func (doc *Document) includeResolved(path string, relPath string,
+	stat syscall.Stat_t) (incdoc *Document, oerr *Error) {
 	// make sure we dont re-include anything
 	for _, d := range *doc.allIncluded {
 		if d.fileInode == stat.Ino {
@@ -535,26 +1100,23 @@ func (doc *Document) include(path string) (incdoc *Document, oerr *Error) {
 
 }
 
-// prevent duplicate definitions
-func (doc *Document) addDefinition(definition NormalDefinition) *Error {
-	for _, d := range *doc.allDefinitions {
-		if d.GetFullName() == definition.GetFullName() {
-			oerr := NewError(errAlreadyDefined)
-			oerr.SetSubjectf(d.GetFullName())
-			return oerr
+//TODO: VIOLATION: This document is exceeding 500 lines.
+// looks for the #local definitions of the document being read by reader and
+// then of the documents that it's being read through (see
+// nonConvertedFile.includer) before looking at the root's definitions.
+func (doc *Document) findDefinitionByName(FullName string,
+	reader *nonConvertedFile) *NormalDefinition {
+	for f := reader; f != nil; f = f.includer {
+		d := f.sourceDocument
+		for i := range d.localDefinitions {
+			if d.localDefinitions[i].GetFullName() == FullName {
+				return &d.localDefinitions[i]
+			}
 		}
 	}
-
-	*doc.allDefinitions = append(*doc.allDefinitions, definition)
-	return nil
-}
-
-//TODO: VIOLATION: This document is exceeding 500 lines.
-func (doc Document) findDefinitionByName(FullName string) *NormalDefinition {
 	for i := 0; i < len(*doc.allDefinitions); i++ {
-		d := (*doc.allDefinitions)[i]
-		if d.GetFullName() == FullName {
-			return &d
+		if (*doc.allDefinitions)[i].GetFullName() == FullName {
+			return &(*doc.allDefinitions)[i]
 		}
 	}
 	return nil
@@ -590,6 +1152,7 @@ func (doc *Document) Read(dest []byte) (int,
 
 	// If we have prepends that we haven't read, keep reading those.
 	if doc.prependReadingIndex < len(doc.prepends) {
+		doc.prepends[doc.prependReadingIndex].readBy(doc.ConvertedFile)
 		n, cerr := doc.prepends[doc.prependReadingIndex].Read(dest)
 		if cerr != nil && cerr != io.EOF {
 			oerr := NewError(errFailedToReadPrependDocument)
@@ -609,7 +1172,14 @@ func (doc *Document) Read(dest []byte) (int,
 	if !doc.convertedFileDoneReading {
 		// ...we're not. so lets continue reading the content from this document
 		Logger.Debugf("reading (converted) document to buffer %s", doc.path)
-		n, cerr := doc.ConvertedFile.Read(dest)
+		var content io.Reader = doc.ConvertedFile
+		if doc.layout != nil {
+			// the layout is read instead, the content of this document is
+			// only used for its #block's.
+			doc.layout.readBy(doc.ConvertedFile)
+			content = doc.layout
+		}
+		n, cerr := content.Read(dest)
 		if cerr != nil && cerr != io.EOF {
 			oerr := NewError(errFailedToReadDocument)
 			oerr.SetSubject(doc.path)
@@ -631,6 +1201,7 @@ func (doc *Document) Read(dest []byte) (int,
 	if doc.appendReadingIndex < len(doc.appends) {
 		Logger.Debugf("reading from appended file %s", doc.path)
 
+		doc.appends[doc.appendReadingIndex].readBy(doc.ConvertedFile)
 		n, cerr := doc.appends[doc.appendReadingIndex].Read(dest)
 		if cerr != nil && cerr != io.EOF {
 			oerr := NewError(errFailedToReadAppendedDocument)
@@ -664,6 +1235,15 @@ func (doc *Document) Reset() error {
 		oerr.SetBecause(NewError(cerr.Error()))
 		return oerr
 	}
+	if doc.layout != nil {
+		cerr := doc.layout.Reset()
+		if cerr != nil {
+			oerr := NewError(errRewind)
+			oerr.SetSubject(doc.path)
+			oerr.SetBecause(NewError(cerr.Error()))
+			return oerr
+		}
+	}
 	for i := 0; i < doc.prependReadingIndex; i++ {
 		cerr := doc.prepends[i].Reset()
 		if cerr != nil {
@@ -710,6 +1290,12 @@ func (doc *Document) Close() error {
 	}
 
 	// close child docs
+	for _, d := range doc.imports {
+		if d == nil {
+			continue
+		}
+		_ = d.Close()
+	}
 	for _, d := range doc.prepends {
 		// in the case that a prepend failed to load,
 		// it will be nil.
@@ -724,6 +1310,18 @@ func (doc *Document) Close() error {
 		}
 		_ = d.Close()
 	}
+	for _, d := range doc.includes {
+		if d == nil {
+			continue
+		}
+		_ = d.Close()
+	}
+	for _, d := range doc.inlineIncludes {
+		_ = d.Close()
+	}
+	if doc.layout != nil {
+		_ = doc.layout.Close()
+	}
 
 	// does this mark the finish of the compRequest?
 	if doc.root == doc {
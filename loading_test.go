@@ -0,0 +1,88 @@
+package vorlage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "definitions without the content",
+			files: map[string]string{
+				"vars.html": "#define $(Site) My Site\n#macro $(B x) <b>$(x)</b>\n" +
+					"this isn't outputted\n",
+				"doc.html": "#import vars.html\n$(Site) $(B \"hi\")\n",
+			},
+			output: "My Site <b>hi</b>\n"},
+		{name: "the importer's definitions are kept",
+			files: map[string]string{
+				"vars.html": "#define $(Title) vars\n#default $(Site) site\n",
+				"doc.html":  "#import vars.html\n#define $(Title) doc\n$(Title) $(Site)\n",
+			},
+			output: "doc site\n"},
+		{name: "locals are not seen",
+			files: map[string]string{
+				"vars.html": "#local $(L) local\n",
+				"doc.html":  "#import vars.html\n$(L)\n",
+			},
+			output: "$(L)\n"},
+		{name: "imports of imports",
+			files: map[string]string{
+				"site.html": "#define $(Site) site\n",
+				"vars.html": "#import site.html\n#define $(Title) title\n",
+				"doc.html":  "#import vars.html\n$(Title) $(Site)\n",
+			},
+			output: "title site\n"},
+		{name: "quoted path",
+			files: map[string]string{
+				"my vars.html": "#define $(Site) site\n",
+				"doc.html":     "#import \"my vars.html\"\n$(Site)\n",
+			},
+			output: "site\n"},
+		{name: "imported and included",
+			files: map[string]string{
+				"vars.html": "#define $(Site) site\nvars\n",
+				"doc.html":  "#import vars.html\n#prepend vars.html\n$(Site)\n",
+			},
+			output: "vars\nsite\n"},
+		{name: "missing",
+			files: map[string]string{
+				"doc.html": "#import nope.html\n",
+			},
+			fails: "failed to import document"},
+		{name: "circular",
+			files: map[string]string{
+				"vars.html": "#import doc.html\n",
+				"doc.html":  "#import vars.html\n",
+			},
+			fails: "circular"},
+		{name: "no path",
+			files: map[string]string{
+				"doc.html": "#import\n",
+			},
+			fails: "#import missing arguments"},
+	}
+	for _, test := range tests {
+		c := newTestCompiler()
+		out, err := compileFiles(t, c, test.files, "doc.html", nil)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v (%q)", test.name, test.fails,
+					err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
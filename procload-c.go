@@ -47,6 +47,18 @@ import (
 // size_t vorlage_proc_definer_reset_exec(vorlage_proc_definer_reset_wrap f, void *definer) {
 // return f(definer);
 // }
+// typedef int (*vorlage_proc_definer_len_wrap)(void *definer);
+// int vorlage_proc_definer_len_exec(vorlage_proc_definer_len_wrap f, void *definer) {
+// return f(definer);
+// }
+// typedef const char *(*vorlage_proc_definer_field_wrap)(void *definer, int index, const char *name);
+// const char *vorlage_proc_definer_field_exec(vorlage_proc_definer_field_wrap f, void *definer, int index, const char *name) {
+// return f(definer, index, name);
+// }
+// typedef int (*vorlage_proc_definer_raw_wrap)(void *definer);
+// int vorlage_proc_definer_raw_exec(vorlage_proc_definer_raw_wrap f, void *definer) {
+// return f(definer);
+// }
 //
 // char **mallocPointerArray(int len) {
 // return (char **)(malloc(sizeof(char *) * len));
@@ -75,6 +87,11 @@ type cProc struct {
 	vorlage_proc_definer_close unsafe.Pointer
 	vorlage_proc_definer_reset unsafe.Pointer
 
+	// optional function pointers, nil if not defined
+	vorlage_proc_definer_len   unsafe.Pointer
+	vorlage_proc_definer_field unsafe.Pointer
+	vorlage_proc_definer_raw   unsafe.Pointer
+
 	// raw pointers
 	volageProcInfo C.vorlage_proc_info
 }
@@ -220,6 +237,40 @@ func (d descriptorReader) Read(p []byte) (int, error) {
 	}
 	return int(size), nil
 }
+
+// returns -1 if the processor doesn't support lists.
+func (d descriptorReader) Len() int {
+	if d.c.vorlage_proc_definer_len == nil {
+		return -1
+	}
+	f := C.vorlage_proc_definer_len_wrap(d.c.vorlage_proc_definer_len)
+	return int(C.vorlage_proc_definer_len_exec(f, d.ptr))
+}
+func (d descriptorReader) Field(index int, name string) (string, bool) {
+	if d.c.vorlage_proc_definer_field == nil {
+		return "", false
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	f := C.vorlage_proc_definer_field_wrap(d.c.vorlage_proc_definer_field)
+	value := C.vorlage_proc_definer_field_exec(f, d.ptr, C.int(index), cname)
+	if value == nil {
+		return "", false
+	}
+	return C.GoString(value), true
+}
+
+func (d descriptorReader) Raw() bool {
+	if d.c.vorlage_proc_definer_raw == nil {
+		return false
+	}
+	f := C.vorlage_proc_definer_raw_wrap(d.c.vorlage_proc_definer_raw)
+	return int(C.vorlage_proc_definer_raw_exec(f, d.ptr)) != 0
+}
+
+var _ ListDefinition = descriptorReader{}
+var _ RawDefinition = descriptorReader{}
+
 func (c *cProc) DefineVariable(info vorlageproc.DefineInfo, context interface{}) vorlageproc.Definition {
 	var reqinfoContext = (context).(requestContext)
 	reqinfo := reqinfoContext.rinfoInCMemory
@@ -413,6 +464,24 @@ func (c *cProc) loadVorlageSymbols() error {
 		}
 		*s.ptr = p
 	}
+
+	// these symbols are optional.
+	var optionalsyms = []struct {
+		string
+		ptr *unsafe.Pointer
+	}{
+		{"vorlage_proc_definer_len", &c.vorlage_proc_definer_len},
+		{"vorlage_proc_definer_field", &c.vorlage_proc_definer_field},
+		{"vorlage_proc_definer_raw", &c.vorlage_proc_definer_raw},
+	}
+	for _, s := range optionalsyms {
+		p, err := c.getSymbolPointer(s.string)
+		if err != nil {
+			Logger.Debugf("%s does not define %s", c.libname, s.string)
+			continue
+		}
+		*s.ptr = p
+	}
 	return nil
 }
 func (c *cProc) getSymbolPointer(symbol string) (unsafe.Pointer, error) {
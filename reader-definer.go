@@ -1,10 +1,17 @@
 package vorlage
 
-import vorlageproc "ellem.so/vorlageproc"
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"strings"
+)
+
+const InputArgumentSeporator = "="
 
 // todo: I don't think this method should belong to Document...
 // ARCHITECTUAL ERROR.
-func (doc *Document) define(pos variablePos) (vorlageproc.Definition, error) {
+// reader is the file pos was found in (see findDefinitionByName).
+func (doc *Document) define(pos variablePos,
+	reader *nonConvertedFile) (vorlageproc.Definition, error) {
 	var foundDef vorlageproc.Definition
 
 	// we have found a variable in the document.
@@ -13,35 +20,16 @@ func (doc *Document) define(pos variablePos) (vorlageproc.Definition, error) {
 	// first we ask if its a processor variable or a normal variable?
 	if len(pos.processorName) != 0 {
 		// its a processed variable.
-		// lets find the right processor...
-		var pi int
-		for pi = range doc.compiler.processorInfos {
-			if doc.compiler.processorInfos[pi].Name == pos.processorName {
-				break
-			}
-		}
-		if pi == len(doc.compiler.processorInfos) {
-			// processor not found
-			oerr := NewError(errNoProcessor)
-			oerr.SetSubject(pos.String())
+		// lets find the right processor and its variable...
+		pi, procvarIndex, oerr := doc.findProcessorVariable(pos)
+		if oerr != nil {
 			return nil, oerr
 		}
-
-		// at this point we've found the processor now we need to get
-		// its variables to find the right one.
-		// pi = the index of processorInfos that matches
-		// procvarIndex  = the index of vars (array of pointers)
 		vars := doc.compiler.processorInfos[pi].Variables
-		var procvarIndex int
-		for procvarIndex = 0; procvarIndex < len(vars); procvarIndex++ {
-			if vars[procvarIndex].Name == pos.processorVariableName {
-				break
-			}
-		}
-		if procvarIndex == len(vars) {
-			// we didn't find the variable in the processor
-			oerr := NewError(errNotDefinedInProcessor)
-			oerr.SetSubject(pos.String())
+
+		// the arguments given to the variable in the document itself.
+		args, oerr := parseInputArguments(pos, vars[procvarIndex])
+		if oerr != nil {
 			return nil, oerr
 		}
 
@@ -56,10 +44,12 @@ func (doc *Document) define(pos variablePos) (vorlageproc.Definition, error) {
 			StreamInput:  make([]vorlageproc.StreamInput, len(vars[procvarIndex].StreamInputProto)),
 		}
 
-		// static input
+		// static input, the arguments take priority over the request's.
 		for k := range df.Input {
 			name := vars[procvarIndex].InputProto[k].Name
-			if v, ok := doc.compRequest.allInput[name]; ok {
+			if v, ok := args[name]; ok {
+				df.Input[k] = v
+			} else if v, ok := doc.compRequest.allInput[name]; ok {
 				df.Input[k] = v
 			} else {
 				// 0 if not given
@@ -98,11 +88,9 @@ func (doc *Document) define(pos variablePos) (vorlageproc.Definition, error) {
 	} else {
 		// its a normal variable. Easy.
 		// look through all the doucment's normal definitions.
-		for i, d := range *(doc.allDefinitions) {
-			if d.GetFullName() == pos.fullName {
-				foundDef = &((*(doc.allDefinitions))[i])
-				break
-			}
+		if d := doc.findDefinitionByName(pos.fullName, reader); d != nil {
+			foundDef = d
+			Logger.Debugf("%s - defined by %s", pos, d.source)
 		}
 	}
 
@@ -129,6 +117,82 @@ func (doc *Document) define(pos variablePos) (vorlageproc.Definition, error) {
 	return foundDef, nil
 }
 
+// helper func to doc.define
+// finds the processor (pi, the index of processorInfos) and its variable
+// (procvarIndex, the index of its Variables) that pos is referring to.
+func (doc *Document) findProcessorVariable(pos variablePos) (pi int, procvarIndex int, oerr *Error) {
+	for pi = 0; pi < len(doc.compiler.processorInfos); pi++ {
+		if doc.compiler.processorInfos[pi].Name == pos.processorName {
+			break
+		}
+	}
+	if pi == len(doc.compiler.processorInfos) {
+		// processor not found
+		oerr := NewError(errNoProcessor)
+		oerr.SetSubject(pos.String())
+		return pi, 0, oerr
+	}
+
+	// at this point we've found the processor now we need to get
+	// its variables to find the right one.
+	vars := doc.compiler.processorInfos[pi].Variables
+	for procvarIndex = 0; procvarIndex < len(vars); procvarIndex++ {
+		if vars[procvarIndex].Name == pos.processorVariableName {
+			break
+		}
+	}
+	if procvarIndex == len(vars) {
+		// we didn't find the variable in the processor
+		oerr := NewError(errNotDefinedInProcessor)
+		oerr.SetSubject(pos.String())
+		return pi, procvarIndex, oerr
+	}
+	return pi, procvarIndex, nil
+}
+
+// helper func to doc.define
+// parses the arguments of the processor variable at pos (ie
+// $(proc.Var limit=5 tag=news)) into a map of input names to their values.
+// Each name must be one of the variable's InputProto.
+func parseInputArguments(pos variablePos,
+	procvar vorlageproc.ProcessorVariable) (map[string]string, *Error) {
+	args := make(map[string]string, len(pos.args))
+	for _, a := range pos.args {
+		eq := strings.Index(a, InputArgumentSeporator)
+		if eq <= 0 {
+			oerr := NewError(errInputArgument)
+			oerr.SetSubjectf("'%s' in %s", a, pos.rawText)
+			return nil, oerr
+		}
+		name := a[:eq]
+		var i int
+		for i = 0; i < len(procvar.InputProto); i++ {
+			if procvar.InputProto[i].Name == name {
+				break
+			}
+		}
+		if i == len(procvar.InputProto) {
+			oerr := NewError(errUnknownInput)
+			oerr.SetSubjectf("'%s' in %s", name, pos.rawText)
+			return nil, oerr
+		}
+		args[name] = a[eq+len(InputArgumentSeporator):]
+	}
+	return args, nil
+}
+
+// returns true if the variable at pos has a definition without actually
+// defining it. For processor variables, that means the processor has the
+// variable.
+func (doc *Document) isDefined(pos variablePos,
+	reader *nonConvertedFile) bool {
+	if len(pos.processorName) != 0 {
+		_, _, oerr := doc.findProcessorVariable(pos)
+		return oerr == nil
+	}
+	return doc.findDefinitionByName(pos.fullName, reader) != nil
+}
+
 // helper func to doc.define
 // checks to see if input stream was already used. If so, error is returned.
 // if not, marks the input stream as read.
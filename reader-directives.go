@@ -0,0 +1,191 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"io"
+	"io/ioutil"
+)
+
+// helper function for nonConvertedFile.Read
+// returns the next directive (macro in the content) if the source file has
+// been read right up to it and there's nothing left over in tmpBuff.
+// Returns nil otherwise.
+func (c *nonConvertedFile) pendingDirective() *macoPos {
+	if len(c.tmpBuff) != 0 || len(c.trimHeld) != 0 ||
+		c.nextDirective >= len(c.directives) {
+		return nil
+	}
+	d := c.directives[c.nextDirective]
+	if int64(d.charPos)-c.contentStart != c.bytesRead {
+		return nil
+	}
+	return d
+}
+
+// helper function for nonConvertedFile.readSource
+// returns how many bytes can be read from the source file before running
+// into the next directive. Returns -1 if there are no more directives.
+func (c *nonConvertedFile) bytesUntilDirective() int64 {
+	if c.nextDirective >= len(c.directives) {
+		return -1
+	}
+	d := c.directives[c.nextDirective]
+	return int64(d.charPos) - c.contentStart - c.bytesRead
+}
+
+// starts reading def on the next read (see readDefinition). name is put on
+// the definition stack so it's popped off again once def is done reading.
+func (c *nonConvertedFile) startDefinition(name string, def vorlageproc.Definition) {
+	*c.definitionStack = append(*c.definitionStack, name)
+	c.currentlyReadingDef = def
+}
+
+// discards the next n bytes of the source file.
+func (c *nonConvertedFile) skipSource(n int64) error {
+	skipped, err := io.CopyN(ioutil.Discard, c.sourceFile, n)
+	c.bytesRead += skipped
+	if err != nil {
+		oerr := NewError(errFailedToReadBytes)
+		oerr.SetSubject(c.sourceDocument.path)
+		oerr.SetBecause(NewError(err.Error()))
+		return oerr
+	}
+	return nil
+}
+
+// moves the source file to right after the directive d, skipping everything
+// in between (including other directives). d must not be behind the source
+// file.
+func (c *nonConvertedFile) jumpPast(d *macoPos) error {
+	var i int
+	for i = c.nextDirective; i < len(c.directives); i++ {
+		if c.directives[i] == d {
+			break
+		}
+	}
+	if i == len(c.directives) {
+		// already past it
+		return nil
+	}
+	c.nextDirective = i + 1
+	return c.skipSource(int64(d.charPos) + int64(d.length) - c.contentStart - c.bytesRead)
+}
+
+// moves the source file back to right after the directive d.
+func (c *nonConvertedFile) jumpBackTo(d *macoPos) error {
+	var i int
+	for i = 0; i < len(c.directives); i++ {
+		if c.directives[i] == d {
+			break
+		}
+	}
+	err := c.sourceFile.Reset()
+	if err != nil {
+		oerr := NewError(errRewind)
+		oerr.SetSubject(c.sourceDocument.path)
+		oerr.SetBecause(NewError(err.Error()))
+		return oerr
+	}
+	c.bytesRead = 0
+	c.nextDirective = i + 1
+	return c.skipSource(int64(d.charPos) + int64(d.length) - c.contentStart)
+}
+
+// helper function for runDirective
+// goes through the branches of the block started by cond until a branch
+// evaluates to true (or is an #else) and moves the source file into that
+// branch. If no branch is taken, the source file is moved past the #endif.
+func (c *nonConvertedFile) enterConditional(cond *conditional) error {
+	for ; cond != nil; cond = cond.next {
+		switch cond.pos.args[0] {
+		case ElseStr, EndifStr:
+			return c.jumpPast(cond.pos)
+		}
+		ok, err := c.evaluate(cond)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return c.jumpPast(cond.pos)
+		}
+	}
+	return nil
+}
+
+// runs the directive d. The source file must be sitting right on top of it
+// (see pendingDirective). Once ran, the source file will be placed after it.
+func (c *nonConvertedFile) runDirective(d *macoPos) error {
+	// trim markers don't reach past macros.
+	c.trimNext = false
+
+	// if we started drawing a variable right before the macro then it
+	// can't be a variable as macros take up the whole line. So output what
+	// was drawn as-is and come back to the macro on the next read.
+	if c.variableReadBuffer[0] != 0 {
+		var j int
+		for j = 0; j < len(c.variableReadBuffer) && c.variableReadBuffer[j] != 0; j++ {
+		}
+		c.startDefinition("", &NormalDefinition{value: string(c.variableReadBuffer[:j])})
+		for j = 0; j < len(c.variableReadBuffer); j++ {
+			c.variableReadBuffer[j] = 0
+		}
+		return nil
+	}
+
+	Logger.Debugf("running '%s' in %s (%s)", d.args[0], c.sourceDocument.path, d.ToString())
+	c.nextDirective++
+	err := c.skipSource(int64(d.length))
+	if err != nil {
+		return err
+	}
+
+	switch d.args[0] {
+	case IncludeStr:
+		inc := c.sourceDocument.includedAt(d)
+		inc.readBy(c)
+		cerr := inc.Reset()
+		if cerr != nil {
+			return cerr
+		}
+		c.startDefinition(IncludeStr+" "+inc.path, inc)
+	case IfStr, IfdefStr, IfndefStr:
+		return c.enterConditional(c.sourceDocument.conditionals[d])
+	case ElifStr, ElseStr:
+		// if we've read our way into an #elif or #else then the branch before
+		// it was taken. So the rest of the block must be skipped.
+		return c.jumpPast(c.sourceDocument.conditionals[d].end)
+	case EndifStr:
+		// nothing to do, the block is done.
+	case ForeachStr:
+		return c.enterForeach(c.sourceDocument.loops[d])
+	case EndforeachStr:
+		return c.continueForeach(c.sourceDocument.loops[d])
+	case BlockStr:
+		block := c.sourceDocument.blocks[d]
+		override := block.override()
+		if override == block {
+			// nobody has replaced it, so just keep reading.
+			return nil
+		}
+		c.startDefinition(BlockStr+" "+block.name, c.blockReader(override))
+		return c.jumpPast(block.end)
+	case EndblockStr:
+		// nothing to do, the block is done.
+	case RawStr:
+		end := c.sourceDocument.verbatim[d]
+		start := int64(d.charPos) + int64(d.length)
+		c.startDefinition(RawStr, sectionFile{
+			io.NewSectionReader(c.sourceDocument.rawFile, start,
+				int64(end.charPos)-start),
+		})
+		return c.jumpPast(end)
+	case EndrawStr:
+		// nothing to do, it was jumped past by #raw.
+	case DefineStr, MacroStr, DefaultStr, OverrideStr, UndefStr, LocalStr,
+		InputStr, StatusStr, HeaderStr, ContentTypeStr, RedirectStr,
+		ImportStr, PrependStr, AppendStr:
+		// already taken care of when the document was loaded (see
+		// Compiler.ContentMacros), all that's needed is to not output the line.
+	}
+	return nil
+}
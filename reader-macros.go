@@ -0,0 +1,125 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"regexp"
+	"strings"
+)
+
+const MacroParameterSeporator = ","
+const MacroParameterRegexp = `^` + NameRegexp + `$`
+
+var macroParameterRegexpProc = regexp.MustCompile(MacroParameterRegexp)
+
+// creates the definition of a #macro. The first argument(s) of m are the
+// signature (ie "$(Card title,href)") and the rest are the definition's
+// value. The signature is written with delims.
+func createMacroDefinition(m *macoPos, delims Delimiters) (NormalDefinition,
+	*Error) {
+	args := m.args[1:]
+	// the signature may have been split into multiple arguments because
+	// the parameters can be separated by spaces too.
+	var i int
+	for i = 0; i < len(args) && !strings.HasSuffix(args[i], delims.Suffix); i++ {
+	}
+	if i >= len(args)-1 {
+		return NormalDefinition{}, NewError("#macro missing arguments")
+	}
+	signature := strings.Join(args[:i+1], string(MacroArgument))
+	if !strings.HasPrefix(signature, delims.Prefix) ||
+		len(signature) < len(delims.Prefix)+len(delims.Suffix) {
+		oerr := NewError(errVariableMissingPrefix)
+		oerr.SetSubject(signature)
+		return NormalDefinition{}, oerr
+	}
+	name := signature[len(delims.Prefix) : len(signature)-len(delims.Suffix)]
+	var paramlist string
+	if space := strings.IndexByte(name, MacroArgument); space != -1 {
+		name, paramlist = name[:space], name[space+1:]
+	}
+
+	params := []string{}
+	for _, p := range strings.Split(paramlist, MacroParameterSeporator) {
+		p = strings.TrimSpace(p)
+		if p == "" && paramlist == "" {
+			break
+		}
+		if !macroParameterRegexpProc.MatchString(p) {
+			oerr := NewError("#macro parameter has an invalid name")
+			oerr.SetSubjectf("'%s' in %s", p, signature)
+			return NormalDefinition{}, oerr
+		}
+		params = append(params, p)
+	}
+
+	def, err := createNormalDefinition(VariablePrefix+name+VariableSuffix,
+		m.value(i+2))
+	def.params = params
+	return def, err
+}
+
+// helper function for nonConvertedFile.define
+// makes sure the arguments at pos can be given to def.
+func checkMacroArguments(def vorlageproc.Definition, pos variablePos) *Error {
+	macro, ok := def.(*NormalDefinition)
+	if !ok || macro.params == nil {
+		oerr := NewError(errNotAMacro)
+		oerr.SetSubject(pos.rawText)
+		return oerr
+	}
+	if len(pos.args) > len(macro.params) {
+		oerr := NewError(errMacroArguments)
+		oerr.SetSubjectf("%s was given %d but takes %d", pos.rawText,
+			len(pos.args), len(macro.params))
+		return oerr
+	}
+	return nil
+}
+
+// macroArguments are the arguments given to a #macro (keyed by their
+// parameter's name). They are read the same way as the fields of a
+// #foreach so they're a list of one record. They were written by the
+// author of the document so they're never escaped.
+type macroArguments struct {
+	RecordList
+}
+
+func (macroArguments) Raw() bool {
+	return true
+}
+
+var _ RawDefinition = macroArguments{}
+
+// creates a file that reads def (which is the normal definition of pos) while
+// defining its variables. If def is a #macro, the arguments given at pos are
+// defined inside of it.
+func (c *nonConvertedFile) nestedReader(def vorlageproc.Definition,
+	pos variablePos) *nonConvertedFile {
+	scopes := c.scopes
+	delims := c.delims
+	if normal, ok := def.(*NormalDefinition); ok && normal.delims.Prefix != "" {
+		delims = normal.delims
+	}
+	if macro, ok := def.(*NormalDefinition); ok && macro.params != nil {
+		// parameters that were not given an argument are left undefined.
+		args := make(map[string]string, len(pos.args))
+		for i := range pos.args {
+			args[macro.params[i]] = pos.args[i]
+		}
+		// copy scopes so appending to it doesn't affect our own.
+		scopes = append(scopes[:len(scopes):len(scopes)], &listScope{
+			list: macroArguments{RecordList{args}},
+		})
+	}
+	return &nonConvertedFile{
+		sourceDocument:     c.sourceDocument,
+		sourceFile:         def,
+		includer:           c.includer,
+		delims:             delims,
+		escapeFilter:       c.escapeFilter,
+		variableReadBuffer: newVariableReadBuffer(c.sourceDocument.compiler.maxVariableLength()),
+		definitionStack:    c.definitionStack,
+		scopes:             scopes,
+		inheritedScopes:    len(scopes),
+	}
+}
@@ -0,0 +1,117 @@
+package vorlage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateMacroDefinition(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		params []string
+		value  string
+		fails  bool
+	}{
+		{line: "#macro $(Card title,href) <a>$(title)</a>", name: "$(Card)",
+			params: []string{"title", "href"}, value: "<a>$(title)</a>"},
+		{line: "#macro $(Card title, href) x", name: "$(Card)",
+			params: []string{"title", "href"}, value: "x"},
+		{line: "#macro $(None) x", name: "$(None)", params: []string{},
+			value: "x"},
+		{line: `#macro $(Q a) "<$(a)>"`, name: "$(Q)", params: []string{"a"},
+			value: "<$(a)>"},
+		{line: `#macro $(Q a) "$(a)" and "$(a)"`, name: "$(Q)",
+			params: []string{"a"}, value: `"$(a)" and "$(a)"`},
+		{line: "#macro $(Card title)", fails: true},
+		{line: "#macro $(Card title,) x", fails: true},
+		{line: "#macro $(Card a b) x", fails: true},
+		{line: "#macro Card x", fails: true},
+	}
+	for _, test := range tests {
+		args, starts, _, err := splitMacroArguments(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		m := &macoPos{args: args, argStarts: starts, line: test.line}
+		def, err := createMacroDefinition(m, DefaultDelimiters)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if def.variable != test.name || def.value != test.value ||
+			strings.Join(def.params, ",") != strings.Join(test.params, ",") ||
+			def.params == nil {
+			t.Errorf("%s: got %q %q %q", test.line, def.variable, def.params,
+				def.value)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	card := "#macro $(Card title,href) <a href=\"$(href|#)\">$(title)</a>\n"
+	tests := []struct {
+		name   string
+		doc    string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "arguments",
+			doc:    card + "$(Card \"About me\" \"/about\")\n",
+			output: "<a href=\"/about\">About me</a>\n"},
+		{name: "missing arguments are undefined",
+			doc:    card + "$(Card \"Home\")\n$(Card)\n",
+			output: "<a href=\"#\">Home</a>\n<a href=\"#\">$(title)</a>\n"},
+		{name: "quoted value",
+			doc:    "#macro $(Q a) \"[$(a)]\"\n$(Q \"a b\")\n",
+			output: "[a b]\n"},
+		{name: "escaped quotes in an argument",
+			doc:    "#macro $(Q a) $(a)\n$(Q \"say \\\"hi\\\"\")\n",
+			output: "say \"hi\"\n"},
+		{name: "parameters shadow definitions",
+			doc:    "#define $(a) outer\n#macro $(Q a) $(a)\n$(Q \"inner\") $(a)\n",
+			output: "inner outer\n"},
+		{name: "macros using macros",
+			doc: "#macro $(B x) <b>$(x)</b>\n" +
+				"#macro $(P x) <p>$(x)$(B \"inner\")$(x)</p>\n$(P \"outer\")\n",
+			output: "<p>outer<b>inner</b>outer</p>\n"},
+		{name: "arguments that are not quoted",
+			doc:   card + "$(Card Home)\n",
+			fails: errVariableName},
+		{name: "too many arguments",
+			doc:   card + "$(Card \"a\" \"b\" \"c\")\n",
+			fails: errMacroArguments},
+		{name: "not a macro",
+			doc:   "#define $(A) a\n$(A \"b\")\n",
+			fails: errNotAMacro},
+		{name: "uses itself",
+			doc:   "#macro $(M a) $(M \"a\")\n$(M \"x\")\n",
+			fails: errCircularDefinition},
+	}
+	for _, test := range tests {
+		c := newTestCompiler()
+		out, err := compileFiles(t, c, map[string]string{"doc.html": test.doc},
+			"doc.html", nil)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v (%q)", test.name, test.fails,
+					err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
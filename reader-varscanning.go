@@ -1,57 +1,154 @@
 package vorlage
 
-import "strings"
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Delimiters are what variables start and end with in a document. Both must
+// not be empty.
+type Delimiters struct {
+	Prefix string
+	Suffix string
+}
+
+// the Delimiters used by documents that the Compiler wasn't given any for.
+var DefaultDelimiters = Delimiters{VariablePrefix, VariableSuffix}
+
+// returns the name of the variable (ie "{{Name}}") using the default
+// delimiters (ie "$(Name)"), which is how definitions are named no matter
+// what document they came from. If variable doesn't use d it's returned as
+// is.
+func (d Delimiters) canonical(variable string) string {
+	if len(variable) < len(d.Prefix)+len(d.Suffix) ||
+		!strings.HasPrefix(variable, d.Prefix) ||
+		!strings.HasSuffix(variable, d.Suffix) {
+		return variable
+	}
+	return VariablePrefix + variable[len(d.Prefix):len(variable)-len(d.Suffix)] +
+		VariableSuffix
+}
 
 // variablePos is a struct that shows where a varible is, and it's componennts.
 type variablePos struct {
-	fullName     string
+	fullName     string // always uses DefaultDelimiters (see canonical)
 	variableName string
 
 	processorName         string // if "" then it is not a processed variable
 	processorVariableName string // if "" then it is not a processed variable
 	charPos               int64
-	length                uint
+	length                uint // length of the variable as it was written
+
+	// used in place of the definition if it does not have one.
+	fallback    string
+	hasFallback bool
+
+	// the names of the filters the definition is read through, in order.
+	filters []string
+
+	// the arguments given to a #macro.
+	args []string
+
+	// the variable exactly as it was written (fullName will not have the
+	// filters or fallback).
+	rawText string
+
+	// true if the variable was escaped (ie "$$(Name)"), meaning rawText is to
+	// be outputted instead of its definition. rawText will not have the
+	// escape in it but length will.
+	escaped bool
+
+	// true if the variable ends with a trim marker (ie "$(Name~)"), meaning
+	// the whitespace after it is removed. The whitespace in front of a
+	// variable that starts with one is removed as it's read (see
+	// trimBeforeVariables).
+	trimAfter bool
+
+	// if not "", the variable is an inline #include (ie
+	// "$(#include nav.html)") and this is the path that was given to it.
+	include string
 }
 
 // helper-function for detectVariables
 // looks at the buffer and tries to parse a variable out of it.
 // The itself variable must start at the very beginning of the buffer.
-func scanVariable(buffer []byte, charsource int64) (pos variablePos, oerr *Error) {
+func scanVariable(buffer []byte, charsource int64,
+	delims Delimiters) (pos variablePos, oerr *Error) {
 
-	if len(buffer) < len(VariablePrefix)+len(VariableSuffix) {
+	if len(buffer) < len(delims.Prefix)+len(delims.Suffix) {
 		// this buffer isn't big enough to even consider the possibility
 		// of having a variable.
 		return pos, NewError(errBufferTooShort)
 	}
 
+	// a variable that has the first character of the prefix in front of it
+	// is escaped. The prefix may not be ascii (ie "«"), so that character
+	// could be more than one byte.
+	var escaped bool
+	_, escapeLen := utf8.DecodeRuneInString(delims.Prefix)
+	if len(buffer) >= escapeLen+len(delims.Prefix) &&
+		string(buffer[:escapeLen]) == delims.Prefix[:escapeLen] &&
+		strings.HasPrefix(string(buffer[escapeLen:]), delims.Prefix) {
+		escaped = true
+		buffer = buffer[escapeLen:]
+	}
+
 	var length, j, dotIndex int
-	for length = 0; length < len(VariablePrefix); length++ {
-		if buffer[length] != VariablePrefix[length] {
+	for length = 0; length < len(delims.Prefix); length++ {
+		if buffer[length] != delims.Prefix[length] {
 			// no valid prefix, no variable to be found here!
 			return pos, NewError(errVariableMissingPrefix)
 		}
 	}
 
 	for ; length < len(buffer); length++ {
-		// keep scanning through until we find the VariableSuffix
-		if length+len(VariableSuffix) >= len(buffer) {
-			// The VariableSuffix was not found in this buffer.
-			oerr = NewError(errVariableMissingSuffix)
-			return pos, oerr
+		// keep scanning through until we find the suffix
+		if length+len(delims.Suffix) > len(buffer) {
+			break
 		}
 
-		for j = 0; j < len(VariableSuffix); j++ {
-			if buffer[length+j] != VariableSuffix[j] {
+		for j = 0; j < len(delims.Suffix); j++ {
+			if buffer[length+j] != delims.Suffix[j] {
 				break
 			}
 		}
-		if j == len(VariableSuffix) {
+		if j == len(delims.Suffix) {
 			length = length + j
 			break
 		}
 	}
+	if j != len(delims.Suffix) {
+		// The suffix was not found in this buffer.
+		oerr = NewError(errVariableMissingSuffix)
+		return pos, oerr
+	}
+
+	varName := buffer[len(delims.Prefix) : length-len(delims.Suffix)]
+
+	// the trim markers are not part of the name (ie "$(~Name~)"). If there's
+	// a fallback, the marker at the end goes before it (ie "$(Name~|none)")
+	// so fallbacks can still end with one (ie "$(Name|~)").
+	var trimAfter bool
+	if strings.HasPrefix(string(varName), VariableTrimMarker) {
+		varName = varName[len(VariableTrimMarker):]
+	}
+	nameEnd := strings.Index(string(varName), VariableFallbackSeporator)
+	if nameEnd == -1 {
+		nameEnd = len(varName)
+	}
+	if strings.HasSuffix(string(varName[:nameEnd]), VariableTrimMarker) {
+		varName = append(
+			append([]byte{}, varName[:nameEnd-len(VariableTrimMarker)]...),
+			varName[nameEnd:]...)
+		trimAfter = true
+	}
 
-	varName := buffer[len(VariablePrefix) : length-len(VariableSuffix)]
+	// an inline #include is not a variable at all, the document is read in
+	// its place.
+	if strings.HasPrefix(string(varName), IncludeStr+string(MacroArgument)) {
+		return scanInlineInclude(buffer[:length], varName, charsource,
+			escaped, escapeLen, trimAfter)
+	}
 
 	if !variableRegexpProc.Match(varName) {
 		oerr = NewError(errVariableName)
@@ -60,12 +157,48 @@ func scanVariable(buffer []byte, charsource int64) (pos variablePos, oerr *Error
 	}
 
 	pos = variablePos{
-		fullName:     string(buffer[:length]),
-		variableName: string(buffer[len(VariablePrefix) : length-len(VariableSuffix)]),
+		variableName: string(varName),
 		charPos:      charsource,
 		length:       uint(length),
+		rawText:      string(buffer[:length]),
+		escaped:      escaped,
+		trimAfter:    trimAfter,
+	}
+	if escaped {
+		pos.length += uint(escapeLen)
+	}
+
+	// the fallback is not part of the variable's name.
+	fallbackIndex := strings.Index(pos.variableName, VariableFallbackSeporator)
+	if fallbackIndex != -1 {
+		pos.fallback = pos.variableName[fallbackIndex+len(VariableFallbackSeporator):]
+		pos.hasFallback = true
+		pos.variableName = pos.variableName[:fallbackIndex]
 	}
 
+	// nor the arguments.
+	argIndex := strings.IndexByte(pos.variableName, MacroArgument)
+	if argIndex != -1 {
+		pos.args, _, _, oerr = splitArguments(pos.variableName[argIndex:], true)
+		if oerr != nil {
+			serr := NewError(errVariableName)
+			serr.SetSubjectf("'%s'", string(varName))
+			serr.SetBecause(oerr)
+			return pos, serr
+		}
+		pos.variableName = pos.variableName[:argIndex]
+	}
+
+	// and neither are the filters.
+	filterIndex := strings.Index(pos.variableName, VariableFilterSeporator)
+	if filterIndex != -1 {
+		pos.filters = strings.Split(
+			pos.variableName[filterIndex+len(VariableFilterSeporator):],
+			VariableFilterSeporator)
+		pos.variableName = pos.variableName[:filterIndex]
+	}
+	pos.fullName = VariablePrefix + pos.variableName + VariableSuffix
+
 	dotIndex = strings.Index(pos.variableName,
 		VariableProcessorSeporator)
 	if dotIndex != -1 {
@@ -76,113 +209,146 @@ func scanVariable(buffer []byte, charsource int64) (pos variablePos, oerr *Error
 	return pos, nil
 }
 
-// reads a variable into dest from src. Returns how many bytes were ignored
-// at the start of src. len(dest) must be >= MaxVariableLength.
-// make sure you use the same dest buffer for subsequent reads.
+// helper-function for scanVariable
+// scans an inline #include (ie "$(#include nav.html)"). text is how it was
+// written and inner is what's between the delimiters without trim markers.
+func scanInlineInclude(text []byte, inner []byte, charsource int64,
+	escaped bool, escapeLen int, trimAfter bool) (pos variablePos, oerr *Error) {
+	args, _, _, aerr := splitArguments(string(inner[len(IncludeStr):]), true)
+	if aerr == nil && len(args) != 1 {
+		aerr = NewError("#include must be given a single path")
+	}
+	if aerr != nil {
+		oerr = NewError(errVariableName)
+		oerr.SetSubjectf("'%s'", string(inner))
+		oerr.SetBecause(aerr)
+		return pos, oerr
+	}
+	pos = variablePos{
+		fullName:     VariablePrefix + IncludeStr + " " + args[0] + VariableSuffix,
+		variableName: IncludeStr + " " + args[0],
+		charPos:      charsource,
+		length:       uint(len(text)),
+		rawText:      string(text),
+		escaped:      escaped,
+		trimAfter:    trimAfter,
+		include:      args[0],
+	}
+	if escaped {
+		pos.length += uint(escapeLen)
+	}
+	return pos, nil
+}
+
+// the size dest starts out as when reading variables (see
+// newVariableReadBuffer). It's grown as longer variables are read.
+const variableReadBufferLength = 64
+
+// returns the buffer that drawParseVar is given for the first time. max is
+// how long variables are allowed to be.
+func newVariableReadBuffer(max int) []byte {
+	if max < variableReadBufferLength {
+		return make([]byte, max)
+	}
+	return make([]byte, variableReadBufferLength)
+}
+
+// reads a variable into *dest from src. *dest will be grown as needed, but
+// never past max bytes. make sure you use the same dest buffer for
+// subsequent reads.
 //
-// returns _,nil,err if an error happened while parsing
-// returns len(src),nil,nil if no variable has been found yet
-// returns 0,nil,nil if the VariablePrefix hasn't been fully read
-// returns >0,nil,nil if a variable has been found but not completely done scanned, send the next block of src over. Be sure to add n to charsource next call.
-// returns _,pos,nil if a variable was found and fully scanned
+// nonVar is how many bytes at the start of src are not part of a variable.
+// used is how many bytes of src have been looked at, src[nonVar:used] will
+// have been added to dest (unless a variable was found, see below).
 //
-// todo: what if we scan a partial prefix on one block,
-//       but then we didn't find it on the second block? We need a way to roll
-//       back a half-prefix-scan... we could try return a negative number?
-func drawParseVar(dest []byte, src []byte,
-	charsource int64) (n int, pos *variablePos, oerr *Error) {
-
-	// we retain i for 2 reasons: 1) we can check of a loop completed and 2)
-	// so if we have just scanned in the start of a new variable from src to
-	// dest, we can start the normal scanning proccess from where we left off
-	// when we discovered the start of the variable.
-	var i = 0
-	var nonVarBytes int
-	var j = 0
+// returns _,_,nil,err if an error happened while parsing
+// returns len(src),len(src),nil,nil if no variable has been found yet
+// returns _,len(src),nil,nil if a variable has been started but not
+// completely scanned, send the next block of src over.
+// returns _,_,pos,nil if a variable was found and fully scanned, src[used:]
+// is what came after it.
+// returns _,_,nil,err if err is errVariableMissingPrefix or
+// errVariableMissingSuffix, dest turned out to not be a variable (ie "$5" or
+// a variable longer than max). dest is left as is, only its first byte is not
+// part of a variable. dest[1:] and src[used:] need to be scanned again.
+func drawParseVar(dest *[]byte, src []byte, charsource int64, delims Delimiters,
+	max int) (nonVar int, used int, pos *variablePos, oerr *Error) {
+
+	buf := *dest
+	var i, j int
 
 	// if the dest starts with null (0), then that means we haven't started
 	// drawing a variable yet. So look at src to see if (and where) we should
 	// start.
-	if dest[0] != VariablePrefix[0] {
-		for ; i < len(src) && src[i] != VariablePrefix[0]; i++ {
+	if buf[0] == 0 {
+		for ; i < len(src) && src[i] != delims.Prefix[0]; i++ {
 		}
 		if i == len(src) {
 			// we're not recording a variable, nor did we find the start of one
 			// in src.
-			return i, nil, nil
+			return i, i, nil, nil
 		}
 	}
-
-	// at this point we've just found, or have previously found at least
-	// the start of a VariablePrefix that is currently in src at index i.
-	// So let's also document how many bytes at the beginning of this buffer
-	// it takes to get to the start to the variabel
-	nonVarBytes = i
+	nonVar = i
 
 	// so lets find where we left off with dest (when dest[j] == 0 that means
 	// we havent written to j yet)
-	for ; j < len(dest) && dest[j] != 0; j++ {
+	for ; j < len(buf) && buf[j] != 0; j++ {
 	}
 
-	// now appended src[i:] to dest
-	for j < len(dest) && i < len(src) {
-		dest[j] = src[i]
-		j++
-		i++
-	}
+	for {
+		// append as much of src[i:] to dest as we can fit.
+		n := copy(buf[j:], src[i:])
+		j += n
+		i += n
 
-	// if the scanned in bytes is shorter than the prefix, then
-	// we need to wait another scan because it's automatically impossible
-	// we've recorder the entire thing.
-	if j < len(VariablePrefix) {
-		return nonVarBytes, nil, nil
-	}
+		// now we call scanVariable that will parse out the variable's
+		// componenets OR it will return an error that will inform us of what
+		// we're missing.
+		scannedPos, serr := scanVariable(buf[:j], charsource+int64(i), delims)
+		if serr == nil {
+			// we have successfully scanned in a good variable. Whatever came
+			// after it in dest was read from src, so give it back.
+			used = i - (j - int(scannedPos.length))
+			for j = 0; j < len(buf); j++ {
+				buf[j] = 0
+			}
+			return nonVar, used, &scannedPos, nil
+		}
 
-	// now we call scanVariable that will parse out the variable's componenets
-	// OR it will return an error that will inform us of what we're missing.
-	scannedPos, serr := scanVariable(dest, charsource+int64(i))
-	if serr != nil {
-		// scanVariable has told us we're missing something... so what is it?
 		switch serr.ErrStr {
-		case errVariableMissingSuffix:
-			// so we didn't scan in a full variable into dest...
-			// now we ask: are we out of room in dest?
-			if j == len(dest) {
-				// we are, then the caller can't draw anymore. so send em the
-				// error. This will happen if len(dest) < MaxVariableLength or
-				// if the variable is simply too long and/or is not terminated
-
-				// but before we return, lets clear out the dest buffer.
-				for j = 0; j < len(dest); j++ {
-					dest[j] = 0
-				}
-				return nonVarBytes, nil, serr
+		case errBufferTooShort, errVariableMissingSuffix:
+			// we didn't scan in a full variable into dest... if there's
+			// nothing left in src, the caller needs to send more over.
+			if i == len(src) {
+				return nonVar, i, nil, nil
 			}
-
-			// if we're not at the end of dest then the caller can call this
-			// function more times until we indeed fill it.
-			return nonVarBytes, nil, nil
-
-		case errVariableMissingPrefix:
-			// theres no prefix. which means the buffer is crap if it doesn't
-			// even start right. So throw the whole thing away.
-			for j = 0; j < len(dest); j++ {
-				dest[j] = 0
+			// otherwise we're out of room in dest. Make it bigger unless
+			// it's already as big as variables are allowed to be, in which
+			// case it was never a variable.
+			if len(buf) >= max {
+				return nonVar, i, nil, NewError(errVariableMissingSuffix)
 			}
-			return len(src), nil, nil
+			size := len(buf) * 2
+			if size > max {
+				size = max
+			}
+			grown := make([]byte, size)
+			copy(grown, buf)
+			buf = grown
+			*dest = buf
+			continue
 
+		case errVariableMissingPrefix:
+			// theres no prefix. The caller will have to roll back.
+			return nonVar, i, nil, serr
 		}
 
 		// unhandled error returned by scanVariable. Example of this is
 		// when the variable uses bad syntax.
-		return nonVarBytes, nil, serr
-	}
-
-	// at this point, we have successfully scanned in a good variable into
-	// scannedpos.
-	// so lets clear the buffer and return it.
-	for j = 0; j < len(dest); j++ {
-		dest[j] = 0
+		for j = 0; j < len(buf); j++ {
+			buf[j] = 0
+		}
+		return nonVar, i, nil, serr
 	}
-	return nonVarBytes, &scannedPos, nil
 }
@@ -0,0 +1,176 @@
+package vorlage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDrawParseVar(t *testing.T) {
+	long := strings.Repeat("n", 70) // crosses variableReadBufferLength
+	tests := []struct {
+		name   string
+		src    []string // given to drawParseVar one after another
+		max    int
+		nonVar int // of the last src
+		used   int // of the last src
+		found  string
+		err    string
+		grown  int // how big dest ends up, if it was grown
+	}{
+		{name: "variable", src: []string{"$(Name) after"},
+			used: 7, found: "$(Name)"},
+		{name: "text before", src: []string{"text $(Name) after"},
+			nonVar: 5, used: 12, found: "$(Name)"},
+		{name: "no variable", src: []string{"no variable"},
+			nonVar: 11, used: 11},
+		{name: "split", src: []string{"ab $(Na", "me) cd"},
+			used: 3, found: "$(Name)"},
+		{name: "split prefix", src: []string{"ab $", "(Name)"},
+			used: 6, found: "$(Name)"},
+		{name: "growth boundary", src: []string{"x $(" + long + ") y"},
+			nonVar: 2, used: 75, found: "$(" + long + ")", grown: 128},
+		{name: "growth boundary split",
+			src:  []string{"x $(" + long[:50], long[50:] + ")"},
+			used: 21, found: "$(" + long + ")", grown: 128},
+		{name: "dollar", src: []string{"$5 and $6"},
+			used: 9, err: errVariableMissingPrefix},
+		{name: "longer than max", src: []string{"$(" + long + ")"},
+			max: 32, used: 32, err: errVariableMissingSuffix, grown: 32},
+		{name: "bad name", src: []string{"$(a!b) d"},
+			used: 8, err: errVariableName},
+	}
+	for _, test := range tests {
+		max := test.max
+		if max == 0 {
+			max = DefaultMaxVariableLength
+		}
+		dest := newVariableReadBuffer(max)
+		var nonVar, used int
+		var pos *variablePos
+		var err *Error
+		for _, src := range test.src {
+			nonVar, used, pos, err = drawParseVar(&dest, []byte(src), 0,
+				DefaultDelimiters, max)
+		}
+		if test.err != "" {
+			if err == nil || err.ErrStr != test.err {
+				t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var found string
+		if pos != nil {
+			found = pos.rawText
+		}
+		if nonVar != test.nonVar || used != test.used || found != test.found {
+			t.Errorf("%s: got %d, %d, %q, expected %d, %d, %q", test.name,
+				nonVar, used, found, test.nonVar, test.used, test.found)
+		}
+		grown := variableReadBufferLength
+		if test.grown != 0 {
+			grown = test.grown
+		}
+		if len(dest) != grown {
+			t.Errorf("%s: dest is %d long, expected %d", test.name, len(dest),
+				grown)
+		}
+	}
+}
+
+func TestScanVariable(t *testing.T) {
+	guillemets := Delimiters{"«", "»"}
+	tests := []struct {
+		buffer    string
+		delims    Delimiters
+		name      string // variableName
+		processor string
+		length    uint
+		escaped   bool
+		trimAfter bool
+		include   string
+		args      string // joined by ","
+		fails     bool
+	}{
+		{buffer: "$(Name) after", name: "Name", length: 7},
+		{buffer: "$(my-name_2)", name: "my-name_2", length: 12},
+		{buffer: "$(Größe)", name: "Größe", length: 10},
+		{buffer: "$(名前)", name: "名前", length: 9},
+		{buffer: "$(café.Prix)", name: "café.Prix", processor: "café",
+			length: 13},
+		{buffer: "$(Name:html|none)", name: "Name", length: 17},
+		{buffer: "$$(Name)", name: "Name", length: 8, escaped: true},
+		{buffer: "««Name»", delims: guillemets, name: "Name", length: 10,
+			escaped: true},
+		{buffer: "«Név»", delims: guillemets, name: "Név", length: 8},
+		{buffer: "$(~Name)", name: "Name", length: 8},
+		{buffer: "$(Name~)", name: "Name", length: 8, trimAfter: true},
+		{buffer: "$(~Name~)", name: "Name", length: 9, trimAfter: true},
+		{buffer: "$(a-)", name: "a-", length: 5},
+		{buffer: "$(-5)", name: "-5", length: 5},
+		{buffer: "$(Name~|none)", name: "Name", length: 13, trimAfter: true},
+		{buffer: "$(Name|~)", name: "Name", length: 9},
+		{buffer: "$$(~Name~)", name: "Name", length: 10, escaped: true,
+			trimAfter: true},
+		{buffer: "«~Név~»", delims: guillemets, name: "Név", length: 10,
+			trimAfter: true},
+		{buffer: "$(#include nav.html)", name: "#include nav.html",
+			length: 20, include: "nav.html"},
+		{buffer: `$(#include "my nav.html"~)`, name: "#include my nav.html",
+			length: 26, trimAfter: true, include: "my nav.html"},
+		{buffer: "$$(#include nav.html)", name: "#include nav.html",
+			length: 21, escaped: true, include: "nav.html"},
+		{buffer: `$(db.Posts limit=5 tag="not news")`, name: "db.Posts",
+			processor: "db", length: 34, args: "limit=5,tag=not news"},
+		{buffer: `$(Card "About me" "/about")`, name: "Card", length: 27,
+			args: "About me,/about"},
+		{buffer: `$(Card "say \"hi\"")`, name: "Card", length: 20,
+			args: "say \"hi\""},
+		{buffer: `$(Card:upper "a" |none)`, name: "Card", length: 23,
+			args: "a"},
+		{buffer: `$(Card Home)`, fails: true},
+		{buffer: `$(Card "a"b)`, fails: true},
+		{buffer: `$(Card "a""b")`, fails: true},
+		{buffer: `$(Card =5)`, fails: true},
+		{buffer: `$(Card "a|b")`, fails: true},
+		{buffer: `$(db.Posts limit=5 news)`, fails: true},
+		{buffer: "$(#include a.html b.html)", fails: true},
+		{buffer: "$(#include )", fails: true},
+		{buffer: "$(#define a)", fails: true},
+		{buffer: "$(~)", fails: true},
+		{buffer: "$(a!b)", fails: true},
+		{buffer: "$(a b\")", fails: true},
+		{buffer: "$(Name", fails: true},
+		{buffer: "Name)", fails: true},
+	}
+	for _, test := range tests {
+		delims := test.delims
+		if delims.Prefix == "" {
+			delims = DefaultDelimiters
+		}
+		pos, err := scanVariable([]byte(test.buffer), 0, delims)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.buffer,
+					pos.variableName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.buffer, err)
+			continue
+		}
+		if pos.variableName != test.name || pos.processorName != test.processor ||
+			pos.length != test.length || pos.escaped != test.escaped ||
+			pos.trimAfter != test.trimAfter || pos.include != test.include ||
+			strings.Join(pos.args, ",") != test.args {
+			t.Errorf("%s: got %q (processor %q, length %d, escaped %v, "+
+				"trim %v, args %q), expected %q (processor %q, length %d, "+
+				"escaped %v, trim %v, args %q)", test.buffer, pos.variableName,
+				pos.processorName, pos.length, pos.escaped, pos.trimAfter,
+				pos.args, test.name, test.processor, test.length, test.escaped,
+				test.trimAfter, test.args)
+		}
+	}
+}
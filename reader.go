@@ -1,6 +1,7 @@
 package vorlage
 
 import (
+	vorlageproc "ellem.so/vorlageproc"
 	"io"
 	"strings"
 )
@@ -31,7 +32,23 @@ func (c *nonConvertedFile) readDefinition(dest []byte) (n int, err error) {
 }
 
 // reads from the source file, or, reads from tmpBuff if that is not empty.
+// Whitespace removed by trim markers is never returned.
 func (c *nonConvertedFile) readSource(dest []byte) (n int, err error) {
+	for {
+		n, err = c.readUntrimmedSource(dest)
+		if n == 0 || !c.trimNext {
+			return n, err
+		}
+		n = c.trimAfterVariable(dest[:n])
+		if n != 0 || err != nil {
+			return n, err
+		}
+		// it was all whitespace, try again.
+	}
+}
+
+// helper-function for readSource
+func (c *nonConvertedFile) readUntrimmedSource(dest []byte) (n int, err error) {
 	// tmpBuff has priority over the file because tmpBuff is filled with
 	// bytes that we previously read from the source file that we cannot read
 	// again.
@@ -42,11 +59,36 @@ func (c *nonConvertedFile) readSource(dest []byte) (n int, err error) {
 		return n, nil
 	}
 
-	// tmpBuff is empty, read from the source file
-	n, err = c.sourceFile.Read(dest)
-	// increment the total amount of bytes read from the source file
-	c.bytesRead += int64(n)
-	return n, err
+	for {
+		// tmpBuff is empty, read from the source file. But don't read past
+		// the next directive, it needs to be ran once we get to it.
+		src := dest
+		if max := c.bytesUntilDirective(); max != -1 && max < int64(len(src)) {
+			src = src[:max]
+		}
+		n, err = c.sourceFile.Read(src)
+		// increment the total amount of bytes read from the source file
+		c.bytesRead += int64(n)
+
+		// nothing can come after what was read if we're at the end of the
+		// file or at the next directive.
+		end := err != nil || c.bytesUntilDirective() == 0
+		kept := c.trimBeforeVariables(src[:n], end)
+		if len(kept) == 0 && !end && n != 0 {
+			// it was all held on to, keep reading.
+			continue
+		}
+		n = copy(dest, kept)
+		if n < len(kept) {
+			// what was held on to from before doesn't fit, save the rest for
+			// the next read.
+			c.tmpBuff = append([]byte{}, kept[n:]...)
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		return n, err
+	}
 }
 
 func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
@@ -66,6 +108,18 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 	// you'll see this a lot in this funciton.
 	dest = dest[n:]
 
+	// before going back to the source file, see if we've landed on a macro
+	// in the content. If so, run it and read whatever it had left us with.
+	if d := c.pendingDirective(); d != nil {
+		cerr := c.runDirective(d)
+		if cerr != nil {
+			return totalBytes, cerr
+		}
+		n, err = c.Read(dest)
+		totalBytes += n
+		return totalBytes, err
+	}
+
 	// sense we're not reading from a definition, we can read from the source
 	// file (or the tmpBuff if available.)
 	n, err = c.readSource(dest)
@@ -79,17 +133,26 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 	// now lets check to see if the source file gave us any variables to chew
 	// on. Also, You will not understand the following code until you understand
 	// drawParseVar.
-	nonVarByteCount, pos, cerr := drawParseVar(c.variableReadBuffer,
+	nonVarByteCount, used, pos, cerr := drawParseVar(&c.variableReadBuffer,
 		dest[:n],
-		c.bytesRead)
+		c.bytesRead,
+		c.delims,
+		c.sourceDocument.compiler.maxVariableLength())
 	// now here we can acutally add these bytes to what has been read.
 	totalBytes += nonVarByteCount
 	if cerr != nil {
-		// some error happened that made parsing impossible, such as a missing
-		// suffix.
+		switch cerr.ErrStr {
+		case errVariableMissingPrefix, errVariableMissingSuffix:
+			// what looked like a variable turned out not to be one (ie
+			// "$5 $(variable)", or it was never terminated).
+			totalBytes += c.rollback(dest[nonVarByteCount:], dest[used:n])
+			return totalBytes, nil
+		}
+		// some error happened that made parsing impossible, such as a bad
+		// variable name.
 		return totalBytes, *cerr
 	}
-	if nonVarByteCount == n {
+	if nonVarByteCount == n && c.variableReadBuffer[0] == 0 {
 		// the entire buffer was found to have no variables in it.
 		// (err is returned because it may be an io.EOF from previous calls)
 		return totalBytes, err
@@ -106,20 +169,22 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 		//                   (a)       (b)(c)
 		//
 		//  (a) = position of nonVarByteCount
-		//  (b) = position of nonVarByteCount + len(pos.fullName)
+		//  (b) = position of used (this isn't always nonVarByteCount +
+		//        pos.length, as the start of the variable could have been
+		//        read in a previous call)
 		//  (c) = position of n (length of string)
 		//
 		// we need to save the extra (ie "abc") to tmpBuff because
 		// dest will be used to read-in the variable and will in turn all
 		// content that was read after the variable from the file.
-		if n > nonVarByteCount+len(pos.fullName) {
+		if n > used {
 
 			// so in here we now that n (c) is bigger than (b). Which means
 			// there's something after the variable that we've scanned in.
 			// lets move it all into tmpBuff.
 
 			// calculate the remaining buffer length (c - b)
-			remainingBuffLen := n - (nonVarByteCount + len(pos.fullName))
+			remainingBuffLen := n - used
 			var newtmpbuf []byte
 
 			// bug fix for the "forgotten tmp buffer" problem:
@@ -163,7 +228,7 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 			// make the tmp buff the size of everything after the variable.
 			newtmpbuf = make([]byte, remainingBuffLen)
 			// copy everything after that variable into that buffer.
-			copyNew := copy(newtmpbuf, dest[nonVarByteCount+len(pos.fullName):n])
+			copyNew := copy(newtmpbuf, dest[used:n])
 
 			// see "forgotten tmp buffer" problem above
 			copy(newtmpbuf[copyNew:], c.tmpBuff)
@@ -171,9 +236,21 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 			c.tmpBuff = newtmpbuf
 		}
 
+		// whatever whitespace comes after the variable is skipped if it
+		// ends with a trim marker.
+		c.trimNext = pos.trimAfter && !pos.escaped
+
 		// first go back to the Document and find this variable's definition
+		// (unless it's escaped, then it's outputted as it was written)
 		var definitionError *Error
-		def, derr := c.sourceDocument.define(*pos)
+		var def vorlageproc.Definition
+		var nested bool
+		var derr error
+		if pos.escaped {
+			def = &NormalDefinition{value: pos.rawText}
+		} else {
+			def, nested, derr = c.define(*pos)
+		}
 		if derr != nil {
 			var ok bool
 			if definitionError, ok = derr.(*Error); ok {
@@ -206,7 +283,13 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 			// elegant solution indeed.
 			// To detect if def is a non-variable, just check if definitionError
 			// is non-nil
-			def = &NormalDefinition{value: pos.fullName}
+			def = &NormalDefinition{value: pos.rawText}
+
+			// unless of course the variable has a fallback, that's what
+			// should be outputted instead.
+			if pos.hasFallback {
+				def = &NormalDefinition{value: pos.fallback}
+			}
 		}
 		// lets start reading it on the next read by setting c.currentlyReadingDef
 		// to a non-nil value (see readDefinition)
@@ -218,7 +301,7 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 		// read from other definitions.
 		// we also have to make sure that it's a valid variable and not
 		// just variable name defining itself (see Non-variables)
-		if pos.processorName == "" && definitionError == nil {
+		if nested && definitionError == nil {
 			// but before we go on, lets make sure we are not running into
 			// a recursively defining defintion.
 			for i := 0; i < len(*c.definitionStack)-1; i++ {
@@ -232,18 +315,34 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 				oerr.SetSubjectf("%s", strings.Join(attemptedstack, " -> "))
 				return totalBytes, oerr
 			}
-			c.currentlyReadingDef = &nonConvertedFile{
-				sourceDocument:     c.sourceDocument,
-				sourceFile:         def,
-				variableReadBuffer: make([]byte, MaxVariableLength),
-				definitionStack:    c.definitionStack,
-			}
+			c.currentlyReadingDef = c.nestedReader(def, *pos)
 		} else {
-			// it is a processor variable, do not allow nested variables to be
-			// defined.
+			// it is a processor variable (or a field of one), do not allow
+			// nested variables to be defined.
 			c.currentlyReadingDef = def
 		}
 
+		// the filters are given what the definition outputs, so for normal
+		// variables that's after the nested variables have been defined.
+		// processor definitions that weren't given any filters will be
+		// escaped for the type of document being requested.
+		filterNames := pos.filters
+		if len(filterNames) == 0 && !nested && definitionError == nil &&
+			!pos.escaped && pos.include == "" {
+			if f := c.autoEscapeFilter(def); f != "" {
+				filterNames = []string{f}
+			}
+		}
+		if len(filterNames) != 0 && definitionError == nil && !pos.escaped {
+			filtered, ferr := newFilteredDefinition(c.currentlyReadingDef,
+				filterNames)
+			if ferr != nil {
+				ferr.SetSubjectf("%s in %s", ferr.Subject, pos.rawText)
+				return totalBytes, ferr
+			}
+			c.currentlyReadingDef = filtered
+		}
+
 		// This next if statment is completely optional.
 		// all this does is ask if there's any more space in dest we haven't
 		// used. Without this if statment, the caller would just have to call
@@ -262,9 +361,43 @@ func (c *nonConvertedFile) Read(dest []byte) (totalBytes int, err error) {
 	// at this point we know that a variable was not found, but not all bytes were
 	// ignored. Which means we STARTED to scan a variable but we need to call
 	// another read to grab the rest of it.
+	if err == io.EOF {
+		// ...unless there's nothing left to read, then it was never a
+		// variable (ie the document ends with "$(").
+		totalBytes += c.rollback(dest[nonVarByteCount:], nil)
+		return totalBytes, nil
+	}
 	return totalBytes, err
 }
 
+// helper-function for Read
+// what's in variableReadBuffer turned out to not be a variable. Its first
+// byte is written to dest and everything after it (followed by rest) is put
+// into tmpBuff to be read again, as there could still be a variable in it (ie
+// "$$5 $(variable)"). Returns how many bytes were written to dest.
+func (c *nonConvertedFile) rollback(dest []byte, rest []byte) int {
+	if len(dest) == 0 {
+		// the caller will have to call Read again.
+		return 0
+	}
+	var j int
+	for ; j < len(c.variableReadBuffer) && c.variableReadBuffer[j] != 0; j++ {
+	}
+	// rest could be part of dest, so it must be copied before dest is
+	// written to (see "forgotten tmp buffer" problem above).
+	newtmpbuf := make([]byte, 0, j-1+len(rest)+len(c.tmpBuff))
+	newtmpbuf = append(newtmpbuf, c.variableReadBuffer[1:j]...)
+	newtmpbuf = append(newtmpbuf, rest...)
+	newtmpbuf = append(newtmpbuf, c.tmpBuff...)
+	c.tmpBuff = newtmpbuf
+
+	dest[0] = c.variableReadBuffer[0]
+	for j = 0; j < len(c.variableReadBuffer); j++ {
+		c.variableReadBuffer[j] = 0
+	}
+	return 1
+}
+
 func (c *nonConvertedFile) Reset() error {
 	//clear the variable buffer
 	for i := 0; i < len(c.variableReadBuffer); i++ {
@@ -277,6 +410,13 @@ func (c *nonConvertedFile) Reset() error {
 	}
 
 	c.bytesRead = 0
+	c.nextDirective = 0
+	c.trimHeld = nil
+	c.trimNext = false
+	for _, s := range c.scopes[c.inheritedScopes:] {
+		_ = s.list.Close()
+	}
+	c.scopes = c.scopes[:c.inheritedScopes]
 	return nil
 }
 
@@ -288,6 +428,9 @@ func (c *nonConvertedFile) Close() error {
 	if c.currentlyReadingDef != nil {
 		_ = c.currentlyReadingDef.Close()
 	}
+	for _, s := range c.scopes[c.inheritedScopes:] {
+		_ = s.list.Close()
+	}
 
 	err := c.sourceFile.Close()
 	if err != nil {
@@ -0,0 +1,115 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"strings"
+	"testing"
+)
+
+func TestEscaping(t *testing.T) {
+	proc := &testProcessor{
+		info: vorlageproc.ProcessorInfo{
+			Name:      "p",
+			Variables: []vorlageproc.ProcessorVariable{{Name: "Html"}},
+		},
+		defines: map[string]func(vorlageproc.DefineInfo) vorlageproc.Definition{
+			"Html": func(vorlageproc.DefineInfo) vorlageproc.Definition {
+				return &NormalDefinition{value: "<b>"}
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		path       string
+		doc        string
+		delimiters map[string]Delimiters
+		output     string
+	}{
+		{name: "normal variable",
+			doc:    "#define $(Name) Kevin\n$$(Name) is $(Name)\n",
+			output: "$(Name) is Kevin\n"},
+		{name: "filters and fallbacks",
+			doc:    "$$(Name:upper|none) $$(Card \"a\")\n",
+			output: "$(Name:upper|none) $(Card \"a\")\n"},
+		{name: "processor variables are not escaped",
+			doc:    "$$(p.Html) $(p.Html)\n",
+			output: "$(p.Html) &lt;b&gt;\n"},
+		{name: "trim markers are kept",
+			doc:    "a  $$(~Name~)  b\n",
+			output: "a  $(~Name~)  b\n"},
+		{name: "inline includes",
+			doc:    "$$(#include nav.html)\n",
+			output: "$(#include nav.html)\n"},
+		{name: "not a variable",
+			doc:    "$$ $$( $$(a b\n",
+			output: "$$ $$( $$(a b\n"},
+		{name: "delimiters", path: "doc.js",
+			delimiters: map[string]Delimiters{".js": {"{{", "}}"}},
+			doc:        "#define {{Name}} Kevin\n{{{Name}} {{Name}} $$(Name)\n",
+			output:     "{{Name}} Kevin $$(Name)\n"},
+	}
+	for _, test := range tests {
+		c := newTestCompiler(proc)
+		c.AutoEscape = DefaultAutoEscape
+		c.Delimiters = test.delimiters
+		path := test.path
+		if path == "" {
+			path = "doc.html"
+		}
+		out, err := compileFiles(t, c, map[string]string{path: test.doc},
+			path, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		output string
+		fails  string // the error it fails with
+	}{
+		{name: "variables and macros",
+			doc: "#define $(Name) Kevin\n#raw\n#define $(Name) Bob\n" +
+				"#include nav.html\n<p>$(Name) $$(Name)</p>\n#endraw\n$(Name)\n",
+			output: "#define $(Name) Bob\n#include nav.html\n" +
+				"<p>$(Name) $$(Name)</p>\nKevin\n"},
+		{name: "more than once",
+			doc:    "#raw\n$(A)\n#endraw\n$(B|b)\n#raw\n$(C)\n#endraw\n",
+			output: "$(A)\nb\n$(C)\n"},
+		{name: "empty",
+			doc:    "a\n#raw\n#endraw\nb\n",
+			output: "a\nb\n"},
+		{name: "never ended",
+			doc:   "#raw\n$(A)\n",
+			fails: errUnterminatedBlock},
+		{name: "endraw without raw",
+			doc:   "text\n#endraw\n",
+			fails: errUnmatchedBlock},
+	}
+	for _, test := range tests {
+		c := newTestCompiler()
+		out, err := compileFiles(t, c, map[string]string{"doc.html": test.doc},
+			"doc.html", nil)
+		if test.fails != "" {
+			if err == nil || !strings.Contains(err.Error(), test.fails) {
+				t.Errorf("%s: expected %q, got %v (%q)", test.name, test.fails,
+					err, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("%s: got %q, expected %q", test.name, out, test.output)
+		}
+	}
+}
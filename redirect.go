@@ -0,0 +1,138 @@
+package vorlage
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the status code of a #redirect that wasn't given one.
+const DefaultRedirectStatus = 303
+
+// the filter that processor variables in a #redirect's target are read
+// through if they weren't given any, so what they're defined as can't
+// change where the target goes. $(Var:raw) leaves them as they are.
+const redirectEscapeFilter = "url"
+
+// the start of a target that has a scheme (ie "https:")
+var redirectSchemeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.\-]*:`)
+
+// redirectMacro is a #redirect.
+type redirectMacro struct {
+	pos    *macoPos
+	target string // may have variables in it
+	status int
+}
+
+// parses the arguments of a #redirect macro (ie "#redirect /new/path 301")
+func parseRedirect(m *macoPos) (*redirectMacro, *Error) {
+	if len(m.args) < 2 {
+		oerr := NewError("#redirect missing arguments")
+		oerr.SetSubject(m.ToString())
+		return nil, oerr
+	}
+	r := &redirectMacro{pos: m, status: DefaultRedirectStatus}
+	last := len(m.args) - 1
+	// the last argument is only the status code if it's a number, the path
+	// itself may have spaces in it.
+	code, err := strconv.Atoi(m.args[last])
+	if last > 1 && !m.heredoc && err == nil {
+		if code < 300 || code > 399 {
+			oerr := NewError("#redirect must be given a 3xx status code")
+			oerr.SetSubjectf("'%s' %s", m.args[last], m.ToString())
+			return nil, oerr
+		}
+		r.status = code
+
+		// the target is everything before the status code, as it was
+		// written (see macoPos.value).
+		target := *m
+		target.args = m.args[:last]
+		target.argStarts = m.argStarts[:last]
+		target.line = strings.TrimRight(m.line[:m.argStarts[last]],
+			string(MacroArgument))
+		m = &target
+	}
+	r.target = m.value(1)
+	return r, nil
+}
+
+// returns the #redirect of doc, or if it doesn't have one, of the layout it
+// #extends. The #redirect of any other document it includes is ignored. nil
+// is returned if there are none.
+func (doc *Document) findRedirect() (*Document, *redirectMacro) {
+	for d := doc; d != nil; d = d.layout {
+		if d.redirect != nil {
+			return d, d.redirect
+		}
+	}
+	return nil, nil
+}
+
+// defines the variables in the target of r (which is a macro of doc). This
+// must be done after the processors have been given the request.
+func (doc *Document) redirectTarget(r *redirectMacro) (string, error) {
+	file := &nonConvertedFile{
+		sourceDocument:     doc,
+		sourceFile:         &NormalDefinition{value: r.target},
+		delims:             doc.delimiters,
+		escapeFilter:       redirectEscapeFilter,
+		variableReadBuffer: newVariableReadBuffer(doc.compiler.maxVariableLength()),
+		definitionStack:    new([]string),
+	}
+	defer file.Close()
+	target, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	if len(target) == 0 {
+		oerr := NewError("#redirect target is empty")
+		oerr.SetSubjectf("'%s' %s", r.target, r.pos.ToString())
+		return "", oerr
+	}
+	for _, ch := range target {
+		if ch < ' ' || ch == 0x7f {
+			oerr := NewError("#redirect target has control characters")
+			oerr.SetSubjectf("%q %s", target, r.pos.ToString())
+			return "", oerr
+		}
+	}
+
+	// the scheme and host must have been written by the document, not by
+	// its variables.
+	fixed := r.target
+	if i := strings.Index(fixed, doc.delimiters.Prefix); i != -1 {
+		fixed = fixed[:i]
+	}
+	origin := redirectOrigin(string(target))
+	if len(fixed) < origin || fixed[:origin] != string(target[:origin]) {
+		oerr := NewError("#redirect target's scheme or host was not written by the document")
+		oerr.SetSubjectf("'%s' %s", target, r.pos.ToString())
+		return "", oerr
+	}
+	return string(target), nil
+}
+
+// helper-function for redirectTarget
+// returns the length of the start of target that decides which site it goes
+// to: its scheme and its host (including what ends the host). It's 0 for
+// targets on the same site (ie "/new/path" or "new/path"). Browsers ignore
+// the spaces in front of the target, take '\' to be '/', and don't always
+// need a scheme to be followed by "//".
+func redirectOrigin(target string) int {
+	rest := strings.TrimLeft(target, " ")
+	scheme := redirectSchemeRegexp.FindString(rest)
+	afterScheme := rest[len(scheme):]
+	slashes := len(afterScheme) - len(strings.TrimLeft(afterScheme, `/\`))
+	if scheme == "" && slashes < 2 {
+		return 0
+	}
+	// the host goes up until the path, query or fragment.
+	host := len(target) - len(afterScheme) + slashes
+	end := strings.IndexAny(target[host:], `/\?#`)
+	if end == -1 {
+		return len(target)
+	}
+	return host + end + 1
+}
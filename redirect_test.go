@@ -0,0 +1,156 @@
+package vorlage
+
+import (
+	vorlageproc "ellem.so/vorlageproc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRedirectOrigin(t *testing.T) {
+	tests := []struct {
+		target string
+		origin string // the start of target that decides the site
+	}{
+		{"/new/path", ""},
+		{"new/path?a=b", ""},
+		{"%2F%2Fevil.com", ""},
+		{"//evil.com", "//evil.com"},
+		{"//evil.com/x", "//evil.com/"},
+		{`/\evil.com/x`, `/\evil.com/`},
+		{"  //evil.com?x", "  //evil.com?"},
+		{"https://example.com/a", "https://example.com/"},
+		{"https://example.com", "https://example.com"},
+		{"http:/evil.com/a", "http:/evil.com/"},
+		{"http:evil.com#a", "http:evil.com#"},
+		{"mailto:me@example.com", "mailto:me@example.com"},
+	}
+	for _, test := range tests {
+		origin := redirectOrigin(test.target)
+		if test.target[:origin] != test.origin {
+			t.Errorf("%s: got %q, expected %q", test.target,
+				test.target[:origin], test.origin)
+		}
+	}
+}
+
+// redirectActions is a testActions that is also a RedirectHandler.
+type redirectActions struct {
+	testActions
+}
+
+func (a *redirectActions) ActionRedirect(path string, code int) {
+	a.actions = append(a.actions, "redirect "+path+" "+strconv.Itoa(code))
+}
+
+func TestRedirect(t *testing.T) {
+	values := map[string]string{
+		"Slug":  "my post/2",
+		"Host":  "evil.com",
+		"Path":  "//evil.com",
+		"Path2": "/ok",
+		"Tab":   "a\tb",
+	}
+	proc := &testProcessor{
+		info:    vorlageproc.ProcessorInfo{Name: "p"},
+		defines: map[string]func(vorlageproc.DefineInfo) vorlageproc.Definition{},
+	}
+	for name, value := range values {
+		value := value
+		proc.info.Variables = append(proc.info.Variables,
+			vorlageproc.ProcessorVariable{Name: name})
+		proc.defines[name] = func(vorlageproc.DefineInfo) vorlageproc.Definition {
+			return &NormalDefinition{value: value}
+		}
+	}
+	tests := []struct {
+		name   string
+		files  map[string]string
+		action string
+		fails  string // the error it fails with
+	}{
+		{name: "literal",
+			files:  map[string]string{"doc.html": "#redirect /new/path 301\n"},
+			action: "redirect /new/path 301"},
+		{name: "values are escaped",
+			files:  map[string]string{"doc.html": "#redirect /posts/$(p.Slug)\n"},
+			action: "redirect /posts/my+post%2F2 303"},
+		{name: "raw values",
+			files:  map[string]string{"doc.html": "#redirect /posts$(p.Path2:raw)\n"},
+			action: "redirect /posts/ok 303"},
+		{name: "fixed host",
+			files: map[string]string{"doc.html": "" +
+				"#redirect https://example.com/$(p.Path:raw)\n"},
+			action: "redirect https://example.com///evil.com 303"},
+		{name: "escaped host",
+			files:  map[string]string{"doc.html": "#redirect $(p.Path)\n"},
+			action: "redirect %2F%2Fevil.com 303"},
+		{name: "host from a value",
+			files: map[string]string{"doc.html": "#redirect $(p.Path:raw)/x\n"},
+			fails: "scheme or host was not written by the document"},
+		{name: "host extended by a value",
+			files: map[string]string{"doc.html": "" +
+				"#redirect https://example.com$(p.Host:raw)\n"},
+			fails: "scheme or host was not written by the document"},
+		{name: "slashes from a value",
+			files: map[string]string{"doc.html": "" +
+				"#redirect /$(p.Path2:raw)\n"},
+			fails: "scheme or host was not written by the document"},
+		{name: "control characters",
+			files: map[string]string{"doc.html": "#redirect /$(p.Tab:raw)\n"},
+			fails: "#redirect target has control characters"},
+		{name: "empty",
+			files: map[string]string{"doc.html": "#redirect $(p.Nope|)\n"},
+			fails: "#redirect target is empty"},
+		{name: "partials are ignored",
+			files: map[string]string{
+				"doc.html":  "#include part.html\ntext\n",
+				"part.html": "#redirect /elsewhere\n",
+			}},
+		{name: "the layout's",
+			files: map[string]string{
+				"doc.html":    "#extends layout.html\n",
+				"layout.html": "#redirect /elsewhere\n",
+			},
+			action: "redirect /elsewhere 303"},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "vorlage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range test.files {
+			err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content),
+				0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		actions := &redirectActions{}
+		doc, status := newTestCompiler(proc).Compile(
+			filepath.Join(dir, "doc.html"), map[string]string{}, nil, actions)
+		os.RemoveAll(dir)
+		if doc != nil {
+			doc.Close()
+		}
+		switch {
+		case test.fails != "":
+			if status.Err == nil || !strings.Contains(status.Err.Error(),
+				test.fails) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.fails,
+					status.Err)
+			}
+		case test.action == "":
+			if status.Err != nil || len(actions.actions) != 0 {
+				t.Errorf("%s: expected no redirect, got %v %q", test.name,
+					status.Err, actions.actions)
+			}
+		case len(actions.actions) != 1 || actions.actions[0] != test.action:
+			t.Errorf("%s: got %q, expected %q", test.name, actions.actions,
+				test.action)
+		}
+	}
+}
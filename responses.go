@@ -0,0 +1,68 @@
+package vorlage
+
+import (
+	"strconv"
+	"strings"
+)
+
+const HeaderSeporator = ":"
+
+// responseMacro is a #status, #header, or #contenttype. Either status or
+// header is set.
+type responseMacro struct {
+	status int
+	header string
+}
+
+// parses the arguments of a #status, #header, or #contenttype macro.
+func parseResponseMacro(m *macoPos) (r responseMacro, oerr *Error) {
+	if len(m.args) < 2 {
+		oerr = NewError(m.args[0] + " missing arguments")
+		oerr.SetSubject(m.ToString())
+		return r, oerr
+	}
+	switch m.args[0] {
+	case StatusStr:
+		code, err := strconv.Atoi(m.args[1])
+		if err != nil || len(m.args) != 2 || code < 100 || code > 599 {
+			oerr = NewError("#status must be given a single status code")
+			oerr.SetSubjectf("'%s' %s", m.value(1), m.ToString())
+			return r, oerr
+		}
+		r.status = code
+	case HeaderStr:
+		r.header = m.value(1)
+		if i := strings.Index(r.header, HeaderSeporator); i < 1 {
+			oerr = NewError("#header must be given a name and value")
+			oerr.SetSubjectf("'%s' %s", r.header, m.ToString())
+			return r, oerr
+		}
+	case ContentTypeStr:
+		r.header = "Content-Type" + HeaderSeporator + " " + m.value(1)
+	}
+	return r, nil
+}
+
+// gives the #status, #header and #contenttype macros of the documents
+// included by doc, and then doc's own, to handler. That way the requested
+// document's #status is the last one given.
+func (doc *Document) runResponseMacros(handler ActionHandler) {
+	docs := append(append([]*Document{}, *doc.allIncluded...), doc)
+	for _, d := range docs {
+		for _, r := range d.responses {
+			if r.status != 0 {
+				status, ok := handler.(StatusHandler)
+				if !ok {
+					Logger.Warnf("%s set the status to %d but the "+
+						"ActionHandler can't be given it", d.path, r.status)
+					continue
+				}
+				Logger.Debugf("%s set the status to %d", d.path, r.status)
+				status.ActionStatus(r.status)
+			} else {
+				Logger.Debugf("%s set the header '%s'", d.path, r.header)
+				handler.ActionHTTPHeader(r.header)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package vorlage
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"strings"
+)
+
+// written right after the prefix (ie "$(~Name)") the whitespace in front of
+// the variable is removed. Written right before the suffix (ie "$(Name~)")
+// the whitespace after it is removed. It can't be any character that's
+// allowed in variable names (see NameRegexp), otherwise "$(a-)" couldn't
+// be told apart from "$(a)" with a trim marker.
+const VariableTrimMarker = "~"
+
+// the characters that are removed by trim markers and #trim.
+const trimWhitespace = " \t\r\n"
+
+func isTrimWhitespace(b byte) bool {
+	return strings.IndexByte(trimWhitespace, b) != -1
+}
+
+// helper-function for readSource
+// removes the whitespace in front of variables that start with a trim marker
+// (ie "  $(~Name)") from buf, which was just read from the source file. The
+// whitespace at the end of buf can't be looked at until what comes after it
+// has been read, so it's held on to until the next call, unless end is true
+// (nothing can come after it). What's left is returned.
+func (c *nonConvertedFile) trimBeforeVariables(buf []byte, end bool) []byte {
+	if len(c.trimHeld) != 0 {
+		buf = append(c.trimHeld, buf...)
+		c.trimHeld = nil
+	}
+	marker := c.delims.Prefix + VariableTrimMarker
+
+	// whatever is kept is moved to the front of buf.
+	out := buf[:0]
+	for i := 0; i < len(buf); {
+		if !isTrimWhitespace(buf[i]) {
+			out = append(out, buf[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(buf) && isTrimWhitespace(buf[j]) {
+			j++
+		}
+		rest := buf[j:]
+		if !end && len(rest) < len(marker) &&
+			strings.HasPrefix(marker, string(rest)) {
+			// the variable (if it is one) hasn't been fully read yet.
+			c.trimHeld = append([]byte{}, buf[i:]...)
+			return out
+		}
+		if !bytes.HasPrefix(rest, []byte(marker)) {
+			out = append(out, buf[i:j]...)
+		}
+		i = j
+	}
+	return out
+}
+
+// helper-function for readSource
+// removes the whitespace at the start of buf if the last variable ended with
+// a trim marker. Returns how many bytes are left at the start of buf.
+func (c *nonConvertedFile) trimAfterVariable(buf []byte) int {
+	if !c.trimNext {
+		return len(buf)
+	}
+	var i int
+	for i < len(buf) && isTrimWhitespace(buf[i]) {
+		i++
+	}
+	if i < len(buf) {
+		// found something that isn't whitespace.
+		c.trimNext = false
+	}
+	return copy(buf, buf[i:])
+}
+
+// helper-function for detectMacrosPositions and detectBodyMacros
+// if the document has #trim, returns the length of the lines starting at at
+// that are nothing but whitespace (these are removed along with the macro
+// in front of them).
+func (doc *Document) blankLines(at int64) (length int64, lines uint,
+	oerr *Error) {
+	if !doc.trim {
+		return 0, 0, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(doc.rawFile, at,
+		math.MaxInt64-at))
+	for {
+		line, err := reader.ReadString(EndOfLine[len(EndOfLine)-1])
+		if err != nil && err != io.EOF {
+			oerr = &Error{}
+			oerr.ErrStr = errFailedToReadBytes
+			oerr.SetBecause(NewError(err.Error()))
+			return length, lines, oerr
+		}
+		if line == "" || strings.Trim(line, trimWhitespace) != "" {
+			return length, lines, nil
+		}
+		length += int64(len(line))
+		lines++
+		if err == io.EOF {
+			return length, lines, nil
+		}
+	}
+}
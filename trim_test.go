@@ -0,0 +1,77 @@
+package vorlage
+
+import "testing"
+
+func TestTrimBeforeVariables(t *testing.T) {
+	tests := []struct {
+		delims Delimiters
+		reads  []string // given to trimBeforeVariables one after another
+		out    string
+	}{
+		{reads: []string{"a  $(~N) b"}, out: "a$(~N) b"},
+		{reads: []string{"a \n\t $(~N)"}, out: "a$(~N)"},
+		{reads: []string{"a  $(N) b  "}, out: "a  $(N) b  "},
+		{reads: []string{"  $(~N)"}, out: "$(~N)"},
+		{reads: []string{"a $(~N) $(~M)"}, out: "a$(~N)$(~M)"},
+		{reads: []string{"a  $(-N)"}, out: "a  $(-N)"},
+		{reads: []string{"a  $$(~N)"}, out: "a  $$(~N)"},
+
+		// the whitespace can't be outputted until what's after it is read.
+		{reads: []string{"a  ", "", "$(~N)"}, out: "a$(~N)"},
+		{reads: []string{"a  $", "(~N)"}, out: "a$(~N)"},
+		{reads: []string{"a  $(", "~N)"}, out: "a$(~N)"},
+		{reads: []string{"a  $(", "N)"}, out: "a  $(N)"},
+		{reads: []string{"a ", " ", " b"}, out: "a   b"},
+		{reads: []string{"a  "}, out: "a  "},
+
+		{delims: Delimiters{"«", "»"}, reads: []string{"a «~N»"},
+			out: "a«~N»"},
+		{delims: Delimiters{"«", "»"}, reads: []string{"a \xc2", "\xab~N»"},
+			out: "a«~N»"},
+	}
+	for _, test := range tests {
+		c := &nonConvertedFile{delims: test.delims}
+		if c.delims.Prefix == "" {
+			c.delims = DefaultDelimiters
+		}
+		var out string
+		for i, read := range test.reads {
+			end := i == len(test.reads)-1
+			out += string(c.trimBeforeVariables([]byte(read), end))
+		}
+		if out != test.out {
+			t.Errorf("%q: got %q, expected %q", test.reads, out, test.out)
+		}
+		if len(c.trimHeld) != 0 {
+			t.Errorf("%q: %q was still held", test.reads, c.trimHeld)
+		}
+	}
+}
+
+func TestTrimAfterVariable(t *testing.T) {
+	tests := []struct {
+		trimNext bool
+		reads    []string // given to trimAfterVariable one after another
+		out      string
+		trimming bool // if trimNext is still true at the end
+	}{
+		{trimNext: true, reads: []string{"  \n\tb c"}, out: "b c"},
+		{trimNext: false, reads: []string{"  b c"}, out: "  b c"},
+		{trimNext: true, reads: []string{"  ", " \n", " b  c"}, out: "b  c"},
+		{trimNext: true, reads: []string{"b", "  c"}, out: "b  c"},
+		{trimNext: true, reads: []string{"  "}, out: "", trimming: true},
+		{trimNext: true, reads: []string{""}, out: "", trimming: true},
+	}
+	for _, test := range tests {
+		c := &nonConvertedFile{trimNext: test.trimNext}
+		var out string
+		for _, read := range test.reads {
+			buf := []byte(read)
+			out += string(buf[:c.trimAfterVariable(buf)])
+		}
+		if out != test.out || c.trimNext != test.trimming {
+			t.Errorf("%q: got %q (still trimming %v), expected %q (%v)",
+				test.reads, out, c.trimNext, test.out, test.trimming)
+		}
+	}
+}
@@ -24,5 +24,14 @@ inline int vorlage_proc_definer_read(void *definer, char *buf, size_t size);
 inline int vorlage_proc_definer_reset(void *definer);
 inline int vorlage_proc_definer_close(void *definer);
 
+// optional proc definer list functions, only needed if any of your variables
+// are to be used with #foreach (see vorlage_proc_definer_len in processors.h)
+inline int         vorlage_proc_definer_len  (void *definer);
+inline const char *vorlage_proc_definer_field(void *definer, int index, const char *name);
+
+// optional proc definer trust function (see vorlage_proc_definer_raw in
+// processors.h)
+inline int         vorlage_proc_definer_raw  (void *definer);
+
 
 #endif /* VORLAGE_PROCESSORS_INTERFACE_H_ */
@@ -188,5 +188,35 @@ typedef struct {
 	void **streaminputv;
 } vorlage_proc_defineinfo;
 
+/*
+ * A definer returned by vorlage_proc_define can also be a list of records
+ * so the variable can be iterated over with the #foreach macro. Inside of
+ * the #foreach block, the fields of the current record are used as
+ * variables.
+ *
+ * To do this, the processor must define the following (optional)
+ * functions:
+ *
+ *   int vorlage_proc_definer_len(void *definer);
+ *     returns the amount of records in the definer, or -1 if the definer
+ *     is not a list.
+ *
+ *   const char *vorlage_proc_definer_field(void *definer, int index,
+ *                                          const char *name);
+ *     returns the nullterm value of the field called name found in the
+ *     record at index, or NULL if the record does not have that field.
+ *     The returned string must remain valid until the definer is closed.
+ */
+
+/*
+ * Definers are escaped depending on the type of document that was requested
+ * (ie, escaped for html in .html documents) unless the variable was given
+ * filters. A processor that is sure a definer is safe to be outputted as is
+ * can define the following (optional) function:
+ *
+ *   int vorlage_proc_definer_raw(void *definer);
+ *     returns non-zero if the definer is not to be escaped. This also
+ *     applies to the fields of the definer if it's a list.
+ */
 
 #endif /* VORLAGE_PROCESSORS_H_ */